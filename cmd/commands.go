@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"vault-initializer/utility"
+)
+
+// loadCommandSource parses the flags of a single pass command and loads the configuration from the source
+func loadCommandSource(flags *flag.FlagSet, args []string) int {
+	source := addSourceFlags(flags)
+	flags.Parse(args)
+	if err := source.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	source.load()
+	return exitOK
+}
+
+// initCommand only initializes the vault and stores the init keys; the exit code is 0 when the vault
+// is initialized, now or before, and 1 on errors
+func initCommand(args []string) int {
+	if code := loadCommandSource(flag.NewFlagSet("init", flag.ExitOnError), args); code != exitOK {
+		return code
+	}
+	if err := utility.InitializeVault(); err != nil {
+		fmt.Fprintf(os.Stderr, "error while initializing the vault: %v\n", err)
+		return exitError
+	}
+	fmt.Println("Vault is initialized.")
+	return exitOK
+}
+
+// unsealCommand makes a single pass over the vaults and unseals the sealed ones; the exit code is 0 when
+// all of them are unsealed, 4 when some stay sealed and 1 on errors
+func unsealCommand(args []string) int {
+	if code := loadCommandSource(flag.NewFlagSet("unseal", flag.ExitOnError), args); code != exitOK {
+		return code
+	}
+	podStates, err := utility.UnsealVaults()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while unsealing the vault: %v\n", err)
+		return exitError
+	}
+	code := exitOK
+	for _, podState := range podStates {
+		sealState := "unsealed"
+		if podState.Sealed {
+			sealState = "sealed"
+			code = exitNotReady
+		}
+		fmt.Printf("%s %s\n", podState.Name, sealState)
+	}
+	return code
+}
+
+// configureCommand converges the auth methods, the policies and the secret engines once; the exit code
+// is 0 when the vault is converged and 1 on errors
+func configureCommand(args []string) int {
+	if code := loadCommandSource(flag.NewFlagSet("configure", flag.ExitOnError), args); code != exitOK {
+		return code
+	}
+	changes, err := utility.ConfigureVault()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while configuring the vault: %v\n", err)
+		return exitError
+	}
+	fmt.Printf("Vault is configured, %d changes applied.\n", changes)
+	return exitOK
+}
+
+// statusCommand prints the state of every vault; the exit code is 0 when all of them are initialized and
+// unsealed, 4 when any is not and 1 when none can be found
+func statusCommand(args []string) int {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	format := flags.String("format", "text", "output format, text or json")
+	if code := loadCommandSource(flags, args); code != exitOK {
+		return code
+	}
+	if *format != "text" && *format != "json" {
+		fmt.Fprintln(os.Stderr, "-format should be either text or json")
+		return exitUsage
+	}
+
+	statuses := utility.VaultStatus()
+	if len(statuses) == 0 {
+		fmt.Fprintln(os.Stderr, "no vault found")
+		return exitError
+	}
+	code := exitOK
+	for _, status := range statuses {
+		if !status.Initialized || status.Sealed {
+			code = exitNotReady
+		}
+	}
+
+	if *format == "json" {
+		output, _ := json.MarshalIndent(statuses, "", "  ")
+		fmt.Println(string(output))
+		return code
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tADDRESS\tINITIALIZED\tSEALED\tHA ROLE\tVERSION\tERROR")
+	for _, status := range statuses {
+		version := status.Version
+		if len(version) == 0 {
+			version = "-"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%v\t%v\t%s\t%s\t%s\n", status.Name, status.Address, status.Initialized,
+			status.Sealed, status.HARole, version, status.Error)
+	}
+	writer.Flush()
+	return code
+}
+
+// generateRootCommand generates a root token with the stored unseal or recovery keys, once the initial one is
+// revoked; the token is printed, or used to restore the access of the initializer and revoked with -reissue.
+// The exit code is 0 when the token is generated and 1 on errors.
+func generateRootCommand(args []string) int {
+	flags := flag.NewFlagSet("generate-root", flag.ExitOnError)
+	reset := flags.Bool("reset", false, "cancel a generate-root attempt in progress and start over")
+	reissue := flags.Bool("reissue", false, "restore the policy and the login role or the token of the initializer with the root token and revoke it, instead of printing it")
+	if code := loadCommandSource(flags, args); code != exitOK {
+		return code
+	}
+	rootToken, err := utility.GenerateRootToken(*reset, *reissue)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while generating the root token: %v\n", err)
+		return exitError
+	}
+	if *reissue {
+		fmt.Println("Access of the initializer is restored, the generated root token is revoked.")
+		return exitOK
+	}
+	fmt.Println(rootToken)
+	fmt.Fprintln(os.Stderr, "Revoke the root token once done, e.g. vault token revoke -self")
+	return exitOK
+}
+
+// rotateBreakGlassCommand generates new passwords for the break-glass admins given as the arguments, all of
+// them when none is given, and writes them into their secrets; the exit code is 0 when they are rotated and 1
+// on errors
+func rotateBreakGlassCommand(args []string) int {
+	flags := flag.NewFlagSet("rotate-break-glass", flag.ExitOnError)
+	if code := loadCommandSource(flags, args); code != exitOK {
+		return code
+	}
+	rotated, err := utility.RotateBreakGlassPasswords(flags.Args())
+	for _, userName := range rotated {
+		fmt.Printf("Password of %s is rotated.\n", userName)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while rotating the break-glass passwords: %v\n", err)
+		return exitError
+	}
+	return exitOK
+}
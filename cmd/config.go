@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"vault-initializer/utility"
+)
+
+// exit codes of the commands, kept stable for the scripts and the jobs
+const (
+	exitOK       = 0
+	exitError    = 1
+	exitUsage    = 2
+	exitChanges  = 3
+	exitNotReady = 4
+)
+
+// sourceFlags are the flags shared by the commands which load the configuration; each flag defaults to
+// its environment variable, so the same image runs in kubernetes, docker-compose or on a VM
+type sourceFlags struct {
+	configFile     *string
+	configMap      *string
+	resource       *string
+	vaultAddresses *string
+	keyDir         *string
+}
+
+// addSourceFlags adds the configuration source flags to the given flag set
+func addSourceFlags(flags *flag.FlagSet) *sourceFlags {
+	return &sourceFlags{
+		configFile:     flags.String("config", os.Getenv("INIT_CONFIG_FILE"), "path of the local config file, in YAML or JSON, used instead of the config map"),
+		configMap:      flags.String("config-map", os.Getenv("INIT_CONFIG_MAP"), "name of the init config map"),
+		resource:       flags.String("resource", os.Getenv("INIT_RESOURCE"), "name of the VaultInitialization resource, used instead of the config map"),
+		vaultAddresses: flags.String("vault-address", os.Getenv("VAULT_ADDRESSES"), "comma separated addresses of the vaults, e.g. https://vault-1:8200, used instead of discovering the pods"),
+		keyDir:         flags.String("key-dir", os.Getenv("KEY_STORE_DIR"), "directory to keep the init keys and the state in, used instead of the kubernetes secrets"),
+	}
+}
+
+// validate confirms a configuration source is given
+func (source *sourceFlags) validate() error {
+	if len(*source.configFile) == 0 && len(*source.configMap) == 0 && len(*source.resource) == 0 {
+		return fmt.Errorf("-config (or INIT_CONFIG_FILE), -resource (or INIT_RESOURCE) or -config-map (or INIT_CONFIG_MAP) is needed")
+	}
+	return nil
+}
+
+// load sets up the targets and the key store, and parses the configuration from the given source;
+// the config file takes the precedence over the resource, which takes the precedence over the config map
+func (source *sourceFlags) load() {
+	if len(strings.TrimSpace(*source.vaultAddresses)) > 0 {
+		utility.UseStaticTargets(strings.Split(*source.vaultAddresses, ","))
+	}
+	if len(*source.keyDir) > 0 {
+		utility.UseFileKeyStore(*source.keyDir)
+	}
+	if len(*source.configFile) > 0 {
+		utility.ParseInitConfigFile(*source.configFile)
+		return
+	}
+	utility.ConnectK8s()
+	if len(*source.resource) > 0 {
+		utility.ParseInitResource(*source.resource)
+	} else {
+		utility.ParseInitConfigData(*source.configMap)
+	}
+}
@@ -1,18 +1,14 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"os"
+	"strings"
 	"vault-initializer/utility"
 )
 
-var (
-	avail           bool
-	secSharesStr    string
-	secThresholdStr string
-	err             error
-)
-
 func init() {
 	appMode, avail := os.LookupEnv("APP_MODE")
 	if !avail {
@@ -32,22 +28,74 @@ func init() {
 		})
 		log.SetLevel(log.DebugLevel)
 	}
+}
 
-	vaultInitConfigMap, avail := os.LookupEnv("INIT_CONFIG_MAP")
-	if !avail {
-		log.Panic("The initialization config map is not specified")
-	} else {
-		log.Debugf("The initialization config map is specified as %s", vaultInitConfigMap)
-	}
+const usage = `usage: vault-initializer [command] [flags]
 
-	utility.ParseInitConfigData(vaultInitConfigMap)
+commands:
+  run                initializes, unseals and configures the vault, and keeps them so (default)
+  init               initializes the vault and stores the init keys
+  unseal             unseals the sealed vaults once
+  configure          converges the auth methods, policies and secret engines once
+  status             prints the state of every vault
+  plan               prints the changes configure would apply
+  generate-root      generates a root token with the stored keys
+  rotate-break-glass rotates the passwords of the break-glass admins
+  validate           validates a local config file
+  submit-share       submits an unseal share in the manual unseal mode
 
-}
+exit codes: 0 success, 1 error, 2 usage, 3 changes planned, 4 vault not initialized or sealed
+`
 
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		switch os.Args[1] {
+		case "run":
+			os.Exit(runController(os.Args[2:]))
+		case "init":
+			os.Exit(initCommand(os.Args[2:]))
+		case "unseal":
+			os.Exit(unsealCommand(os.Args[2:]))
+		case "configure":
+			os.Exit(configureCommand(os.Args[2:]))
+		case "status":
+			os.Exit(statusCommand(os.Args[2:]))
+		case "submit-share":
+			os.Exit(submitShare(os.Args[2:]))
+		case "plan":
+			os.Exit(plan(os.Args[2:]))
+		case "generate-root":
+			os.Exit(generateRootCommand(os.Args[2:]))
+		case "rotate-break-glass":
+			os.Exit(rotateBreakGlassCommand(os.Args[2:]))
+		case "validate":
+			os.Exit(validate(os.Args[2:]))
+		default:
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(exitUsage)
+		}
+	}
+	os.Exit(runController(os.Args[1:]))
+}
+
+// runController runs the initializer routine against the vault pods in the cluster, or against the vaults
+// at the given addresses; the configuration is read from the config file, the VaultInitialization resource
+// or the config map given through the flags or their environment variables. It returns only on usage errors.
+func runController(args []string) int {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	source := addSourceFlags(flags)
+	flags.Parse(args)
+	if err := source.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	source.load()
+
 	doneCh := make(chan bool)
+	utility.StartStatusServer()
 	go func() {
-		utility.StartRoutine()
+		utility.RunWithLeaderElection(utility.StartRoutine)
 	}()
 	<-doneCh
+	return exitOK
 }
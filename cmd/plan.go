@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"vault-initializer/common"
+	"vault-initializer/utility"
+)
+
+// plan prints the changes the initializer would apply to the vault for the configuration, without writing
+// anything; the exit code is 0 when the vault is up to date, 3 when there are changes and 1 on errors
+func plan(args []string) int {
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	source := addSourceFlags(flags)
+	format := flags.String("format", "text", "output format, text or json")
+	flags.Parse(args)
+
+	if err := source.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if *format != "text" && *format != "json" {
+		fmt.Fprintln(os.Stderr, "-format should be either text or json")
+		return exitUsage
+	}
+
+	source.load()
+	changes, err := utility.PlanVaultConfiguration()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while planning the changes: %v\n", err)
+		return exitError
+	}
+
+	if *format == "json" {
+		if changes == nil {
+			changes = []utility.VaultChange{}
+		}
+		output, _ := json.MarshalIndent(changes, "", "  ")
+		fmt.Println(string(output))
+	} else {
+		printPlan(changes)
+	}
+	if len(changes) > 0 {
+		return exitChanges
+	}
+	return exitOK
+}
+
+// printPlan prints the changes in a human readable form, one line per change followed by the differences
+func printPlan(changes []utility.VaultChange) {
+	if len(changes) == 0 {
+		fmt.Println("No changes, the vault is up to date.")
+		return
+	}
+	counts := make(map[string]int)
+	for _, change := range changes {
+		counts[change.Action]++
+		symbol := "~"
+		switch change.Action {
+		case common.ChangeCreate:
+			symbol = "+"
+		case common.ChangeDelete:
+			symbol = "-"
+		}
+		fmt.Printf("%s %s %s %s\n", symbol, change.Action, change.Kind, change.Name)
+		if change.Current != nil && change.Action != common.ChangeDelete {
+			fmt.Printf("    current: %s\n", indentValue(change.Current))
+		}
+		if change.Desired != nil {
+			fmt.Printf("    desired: %s\n", indentValue(change.Desired))
+		}
+	}
+	fmt.Printf("\nPlan: %d to create, %d to update, %d to write, %d to delete.\n",
+		counts[common.ChangeCreate], counts[common.ChangeUpdate], counts[common.ChangeWrite], counts[common.ChangeDelete])
+}
+
+// indentValue renders the value as it is when it is a string, as JSON otherwise, indented under the change
+func indentValue(value interface{}) string {
+	rendered, isString := value.(string)
+	if !isString {
+		renderedJSON, _ := json.MarshalIndent(value, "", "  ")
+		rendered = string(renderedJSON)
+	}
+	return strings.ReplaceAll(strings.TrimSpace(rendered), "\n", "\n             ")
+}
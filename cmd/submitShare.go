@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"vault-initializer/common"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// submitShare submits a single unseal share of a custodian to the initializer; the share is read
+// from the terminal without echo, or from the standard input when it is piped
+func submitShare(args []string) int {
+	flags := flag.NewFlagSet("submit-share", flag.ExitOnError)
+	address := flags.String("address", os.Getenv("INITIALIZER_ADDR"), "address of the initializer, e.g. https://vault-initializer:8080")
+	caCertFile := flags.String("ca-cert", "", "path of the CA bundle to verify the initializer certificate")
+	flags.Parse(args)
+
+	apiToken := os.Getenv(common.UnsealAPITokenEnv)
+	if len(*address) == 0 || len(apiToken) == 0 {
+		fmt.Fprintf(os.Stderr, "-address (or INITIALIZER_ADDR) and %s are needed to submit the share\n", common.UnsealAPITokenEnv)
+		return exitUsage
+	}
+
+	share, err := readShare()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while reading the share: %v\n", err)
+		return exitError
+	}
+
+	client := &http.Client{}
+	if len(*caCertFile) > 0 {
+		caPEM, err := ioutil.ReadFile(*caCertFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error while reading the CA bundle: %v\n", err)
+			return exitError
+		}
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(caPEM) {
+			fmt.Fprintln(os.Stderr, "no valid certificates found in the CA bundle")
+			return exitError
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: certPool}
+		client.Transport = transport
+	}
+
+	payload, _ := json.Marshal(map[string]string{"key": share})
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(*address, "/")+"/v1/unseal", bytes.NewBuffer(payload))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while building the request: %v\n", err)
+		return exitError
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiToken)
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while submitting the share: %v\n", err)
+		return exitError
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "share is rejected with status %s: %s\n", resp.Status, strings.TrimSpace(string(body)))
+		return exitError
+	}
+
+	var progress common.UnsealProgress
+	if err := json.Unmarshal(body, &progress); err != nil {
+		fmt.Fprintf(os.Stderr, "error while parsing the response: %v\n", err)
+		return exitError
+	}
+	fmt.Printf("Submitted %d of %d shares: %s\n", progress.Submitted, progress.Threshold, progress.Message)
+	if len(progress.FailedPods) > 0 {
+		fmt.Printf("Failed pods: %s\n", strings.Join(progress.FailedPods, ", "))
+		return exitError
+	}
+	return exitOK
+}
+
+// readShare reads the share from the terminal without echo, or the first line of the piped input
+func readShare() (string, error) {
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprint(os.Stderr, "Unseal share: ")
+		share, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return strings.TrimSpace(string(share)), err
+	}
+	share, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && len(share) == 0 {
+		return "", err
+	}
+	return strings.TrimSpace(share), nil
+}
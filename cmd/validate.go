@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"vault-initializer/utility"
+)
+
+// validate validates a local config file without connecting to kubernetes or vault; every broken key
+// is reported on its own line and the exit code is 1 when the config is invalid
+func validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	file := flags.String("f", "", "path of the config map, VaultInitialization or plain config file, in YAML or JSON")
+	flags.Parse(args)
+	if len(*file) == 0 && flags.NArg() == 1 {
+		*file = flags.Arg(0)
+	}
+	if len(*file) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: vault-initializer validate -f <file>")
+		return exitUsage
+	}
+
+	configMap, err := utility.LoadConfigFile(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error while reading the config: %v\n", err)
+		return exitError
+	}
+	if err := utility.ValidateConfigData(configMap.Data); err != nil {
+		if fieldErrs, ok := err.(utility.ValidationErrors); ok {
+			for _, fieldErr := range fieldErrs {
+				fmt.Fprintln(os.Stderr, fieldErr.Error())
+			}
+		} else {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return exitError
+	}
+	fmt.Printf("%s is valid\n", *file)
+	return exitOK
+}
@@ -1,6 +1,9 @@
 package common
 
-import "reflect"
+import (
+	"reflect"
+	"time"
+)
 
 var (
 	//VaultURL                string
@@ -8,6 +11,27 @@ var (
 	SecThreshold            int
 	WaitTimeSeconds         int
 	ReadinessProbeInSeconds int
+	VaultScheme             string
+	VaultPort               int
+	PodResyncPeriodSeconds  int
+	StatusListenAddress     string
+	LeaderElectionEnabled   bool
+	LeaderElectionLeaseName string
+	UnsealMode              string
+	StatusTLSCertFile       string
+	StatusTLSKeyFile        string
+	SealType                string
+	RecoveryShares          int
+	RecoveryThreshold       int
+
+	AutoUnsealGracePeriodSeconds int
+
+	// retry policy, defaulted for the calls made before the config map is parsed
+	RetryMaxAttempts          = DefaultRetryMaxAttempts
+	RetryInitialBackoffMillis = DefaultRetryInitialBackoff
+	RetryMaxBackoffSeconds    = DefaultRetryMaxBackoff
+	RetryJitter               = DefaultRetryJitter
+	RequestTimeoutSeconds     = DefaultRequestTimeout
 )
 
 const (
@@ -18,13 +42,122 @@ const (
 	HttpMethodGET          = "GET"
 	HttpMethodPOST         = "POST"
 	HttpMethodPUT          = "PUT"
+	HttpMethodDELETE       = "DELETE"
 	VaultKeysSecretName    = "vault-init-keys"
+	DefaultVaultScheme     = "http"
+	DefaultVaultPort       = 8200
+	CACertSecretKey        = "ca.crt"
+	DefaultPodResyncPeriod = 30
+	DefaultStatusAddress   = ":8080"
+	DefaultLeaseName       = "vault-initializer-leader"
+	LeaseDuration          = 15
+	LeaseRenewDeadline     = 10
+	LeaseRetryPeriod       = 2
+
+	DefaultRetryMaxAttempts    = 5
+	DefaultRetryInitialBackoff = 500
+	DefaultRetryMaxBackoff     = 30
+	DefaultRetryJitter         = 0.2
+	DefaultRequestTimeout      = 10
+	InitRequestTimeout         = 300
+
+	SealTypeShamir               = "shamir"
+	SealTypeRecovery             = "recovery"
+	DefaultAutoUnsealGracePeriod = 60
+
+	UnsealModeAuto           = "auto"
+	UnsealModeManual         = "manual"
+	VaultTokenEnv            = "VAULT_TOKEN"
+	UnsealAPITokenEnv        = "UNSEAL_API_TOKEN"
+	UnsealShareTTL           = 15
+	KeyWrappingNone          = "none"
+	KeyWrappingKeyFile       = "nacl-keyfile"
+	KeyWrappingPassphrase    = "passphrase"
+	KeyWrappingTransit       = "transit"
+	KeyWrappingPassphraseEnv = "KEY_WRAPPING_PASSPHRASE"
+	TransitTokenEnv          = "TRANSIT_VAULT_TOKEN"
+	DefaultTransitMountPath  = "transit"
+	KeyWrappingAnnotation    = "vault-initializer/key-wrapping"
+	KeyWrappingKeyAnnotation = "vault-initializer/key-wrapping-key"
+	ScryptSaltLength         = 16
+	ScryptN                  = 32768
+	ScryptR                  = 8
+	ScryptP                  = 1
+
+	LDAPAuthPath = "ldap"
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeWrite  = "write"
+	ChangeDelete = "delete"
+
+	ObjectPolicy          = "policy"
+	ObjectSecretEngine    = "secret engine"
+	ObjectAuthMethod      = "auth method"
+	ObjectAuthObject      = "auth object"
+	ObjectAppRoleSecretID = "approle secret id"
+	StateSecretName       = "vault-initializer-state"
+	ManagedObjectsDataKey = "managed-objects"
+
+	ResourceGroup    = "vaultinitializer.gkarthiks.io"
+	ResourceVersion  = "v1alpha1"
+	ResourcePlural   = "vaultinitializations"
+	ResourceKind     = "VaultInitialization"
+	ReconcileSuccess = "Succeeded"
+	ReconcileFailure = "Failed"
+
+	HARoleActive             = "active"
+	HARoleStandby            = "standby"
+	HARolePerformanceStandby = "perf-standby"
+	HARoleStandalone         = "standalone"
+
+	KubernetesAuthPath = "kubernetes"
+
+	InitializerPolicyName         = "vault-initializer"
+	InitializerTokenSecretName    = "vault-initializer-token"
+	DefaultInitializerTokenPeriod = "768h"
+
+	BreakGlassAuthPath     = "userpass"
+	BreakGlassUserPrefix   = "break-glass-"
+	BreakGlassSecretPrefix = "vault-break-glass-"
 )
 
+type VaultInitReq struct {
+	SecretShares      int      `json:"secret_shares,omitempty"`
+	SecretThreshold   int      `json:"secret_threshold,omitempty"`
+	PGPKeys           []string `json:"pgp_keys,omitempty"`
+	RecoveryShares    int      `json:"recovery_shares,omitempty"`
+	RecoveryThreshold int      `json:"recovery_threshold,omitempty"`
+	RecoveryPGPKeys   []string `json:"recovery_pgp_keys,omitempty"`
+	RootTokenPGPKey   string   `json:"root_token_pgp_key,omitempty"`
+}
+
 type VaultInitResp struct {
 	Keys       []string `json:"keys"`
 	KeysBase64 []string `json:"keys_base64"`
 	RootToken  string   `json:"root_token"`
+	// RecoveryKeys are returned instead of the keys with an auto-unseal seal
+	RecoveryKeys       []string `json:"recovery_keys,omitempty"`
+	RecoveryKeysBase64 []string `json:"recovery_keys_base64,omitempty"`
+	// Custodians holds the pgp key names in the order of the encrypted keys
+	Custodians []string `json:"custodians,omitempty"`
+	// RootTokenPGPEncrypted denotes the root token cannot be used by the initializer
+	RootTokenPGPEncrypted bool `json:"root_token_pgp_encrypted,omitempty"`
+	// RootTokenRevoked denotes the root token is revoked after the bootstrap and no longer kept
+	RootTokenRevoked bool `json:"root_token_revoked,omitempty"`
+}
+
+// VaultGenerateRootResp is the progress of a sys/generate-root attempt; the older vault versions
+// return the token as encoded_root_token and expect the otp from the client, signalled by otp_length 0
+type VaultGenerateRootResp struct {
+	Nonce            string `json:"nonce"`
+	Started          bool   `json:"started"`
+	Progress         int    `json:"progress"`
+	Required         int    `json:"required"`
+	Complete         bool   `json:"complete"`
+	EncodedToken     string `json:"encoded_token"`
+	EncodedRootToken string `json:"encoded_root_token"`
+	OTP              string `json:"otp"`
+	OTPLength        int    `json:"otp_length"`
 }
 
 type VaultUnsealResp struct {
@@ -43,6 +176,148 @@ type VaultUnsealResp struct {
 	StorageType  string `json:"storage_type"`
 }
 
+// PodState is the tracked state of an individual vault pod, keyed by its UID
+type PodState struct {
+	UID         string    `json:"uid"`
+	Name        string    `json:"name"`
+	IP          string    `json:"ip"`
+	Sealed      bool      `json:"sealed"`
+	SealedSince time.Time `json:"sealed_since"`
+	LastChecked time.Time `json:"last_checked"`
+	// AutoUnsealFailure denotes the pod stays sealed beyond the grace period with an auto-unseal seal
+	AutoUnsealFailure bool `json:"auto_unseal_failure,omitempty"`
+}
+
+// VaultLeaderResp is the HA state of a vault node as reported by sys/leader
+type VaultLeaderResp struct {
+	HAEnabled          bool   `json:"ha_enabled"`
+	IsSelf             bool   `json:"is_self"`
+	LeaderAddress      string `json:"leader_address"`
+	PerformanceStandby bool   `json:"performance_standby"`
+}
+
+// TargetStatus is the state of an individual vault reported by the status command
+type TargetStatus struct {
+	Name        string `json:"name"`
+	Address     string `json:"address"`
+	Reachable   bool   `json:"reachable"`
+	Initialized bool   `json:"initialized"`
+	Sealed      bool   `json:"sealed"`
+	HARole      string `json:"ha_role"`
+	Version     string `json:"version"`
+	Error       string `json:"error,omitempty"`
+}
+
+// InitializerStatus is the state of the initializer served on the status endpoint
+type InitializerStatus struct {
+	Identity string     `json:"identity"`
+	Leader   string     `json:"leader"`
+	IsLeader bool       `json:"is_leader"`
+	SealType string     `json:"seal_type"`
+	Pods     []PodState `json:"pods"`
+}
+
+// UnsealProgress is the progress of the manual unseal reported back to the custodians
+type UnsealProgress struct {
+	Submitted    int      `json:"submitted"`
+	Threshold    int      `json:"threshold"`
+	Complete     bool     `json:"complete"`
+	UnsealedPods []string `json:"unsealed_pods,omitempty"`
+	FailedPods   []string `json:"failed_pods,omitempty"`
+	Message      string   `json:"message"`
+}
+
+// VaultInitializationSpec is the spec of the VaultInitialization resource, the declarative
+// counterpart of the init config map
+type VaultInitializationSpec struct {
+	VaultLabelSelector string                            `json:"vaultLabelSelector"`
+	SecretShares       int                               `json:"secretShares,omitempty"`
+	SecretThreshold    int                               `json:"secretThreshold,omitempty"`
+	RecoveryShares     int                               `json:"recoveryShares,omitempty"`
+	RecoveryThreshold  int                               `json:"recoveryThreshold,omitempty"`
+	LDAP               LDAPAuthSpec                      `json:"ldap"`
+	Policies           map[string]string                 `json:"policies,omitempty"`
+	SecretEngines      map[string]map[string]interface{} `json:"secretEngines,omitempty"`
+	KubernetesAuth     *KubernetesAuthSpec               `json:"kubernetesAuth,omitempty"`
+	AuthMethods        map[string]AuthMethodSpec         `json:"authMethods,omitempty"`
+	BreakGlass         *BreakGlassSpec                   `json:"breakGlass,omitempty"`
+	Options            map[string]string                 `json:"options,omitempty"`
+}
+
+// LDAPAuthSpec is the LDAP auth method along with the policies bound to its groups and users
+type LDAPAuthSpec struct {
+	Enable         map[string]interface{} `json:"enable,omitempty"`
+	Config         map[string]interface{} `json:"config"`
+	BindPassSecret *SecretKeyRef          `json:"bindPassSecret,omitempty"`
+	Groups         map[string][]string    `json:"groups,omitempty"`
+	Users          map[string][]string    `json:"users,omitempty"`
+}
+
+// AuthMethodSpec is an auth method mounted at its path, along with its config and the roles, users,
+// groups and certs written under auth/<path>/role, users, groups and certs
+type AuthMethodSpec struct {
+	Type        string                            `json:"type"`
+	Description string                            `json:"description,omitempty"`
+	Tune        map[string]interface{}            `json:"tune,omitempty"`
+	Options     map[string]string                 `json:"options,omitempty"`
+	Config      map[string]interface{}            `json:"config,omitempty"`
+	Roles       map[string]map[string]interface{} `json:"roles,omitempty"`
+	Users       map[string]map[string]interface{} `json:"users,omitempty"`
+	Groups      map[string]map[string]interface{} `json:"groups,omitempty"`
+	Certs       map[string]map[string]interface{} `json:"certs,omitempty"`
+	// SecretIDDelivery delivers the role_id and a generated secret_id of the AppRole roles, keyed by the role
+	SecretIDDelivery map[string]SecretIDDelivery `json:"secretIdDelivery,omitempty"`
+}
+
+// SecretIDDelivery is the secret the role_id and the secret_id of an AppRole role are written into, and
+// the period the secret_id is rotated with
+type SecretIDDelivery struct {
+	SecretName     string `json:"secretName"`
+	RotationPeriod string `json:"rotationPeriod,omitempty"`
+}
+
+// KubernetesAuthSpec is the kubernetes auth method along with its roles binding the service accounts and
+// namespaces to the policies; the config is derived from the service account of the initializer
+type KubernetesAuthSpec struct {
+	Path        string                            `json:"path,omitempty"`
+	Description string                            `json:"description,omitempty"`
+	Config      map[string]interface{}            `json:"config,omitempty"`
+	Roles       map[string]map[string]interface{} `json:"roles,omitempty"`
+}
+
+// BreakGlassSpec is the userpass auth method with the generated admin users, for the time the other auth
+// methods are down; the credentials of each user are kept in their own secret, PGP encrypted when the keys
+// are given
+type BreakGlassSpec struct {
+	Path    string   `json:"path,omitempty"`
+	Users   int      `json:"users"`
+	Policy  string   `json:"policy"`
+	PGPKeys []string `json:"pgpKeys,omitempty"`
+}
+
+// SecretKeyRef refers to a key of a secret in the namespace of the initializer
+type SecretKeyRef struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// VaultInitializationStatus is the status of the VaultInitialization resource
+type VaultInitializationStatus struct {
+	ObservedGeneration int64            `json:"observedGeneration"`
+	Initialized        bool             `json:"initialized"`
+	SealType           string           `json:"sealType,omitempty"`
+	Pods               []PodState       `json:"pods"`
+	LastReconcile      *ReconcileResult `json:"lastReconcile,omitempty"`
+}
+
+// ReconcileResult is the outcome of the last reconcile of the vault configuration
+type ReconcileResult struct {
+	Time    time.Time `json:"time"`
+	Result  string    `json:"result"`
+	Message string    `json:"message,omitempty"`
+	Changes int       `json:"changes"`
+}
+
 func (parsedKeys VaultInitResp) IsEmpty() bool {
 	return reflect.DeepEqual(parsedKeys, VaultInitResp{})
 }
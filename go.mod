@@ -4,7 +4,10 @@ go 1.13
 
 require (
 	github.com/gkarthiks/k8s-discovery v0.0.0-20190821062943-753b4c007093
+	github.com/hashicorp/hcl v1.0.0
 	github.com/sirupsen/logrus v1.4.2
+	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
 	k8s.io/api v0.0.0-20190819141258-3544db3b9e44
 	k8s.io/apimachinery v0.17.3
+	k8s.io/client-go v0.0.0-20190819141724-e14f31a72a77
 )
@@ -0,0 +1,155 @@
+package utility
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"vault-initializer/common"
+)
+
+// the keys of the secret the AppRole credentials are delivered into
+const (
+	appRoleRoleIDKey           = "role_id"
+	appRoleSecretIDKey         = "secret_id"
+	appRoleAccessorKey         = "secret_id_accessor"
+	appRolePreviousAccessorKey = "previous_secret_id_accessor"
+	appRoleIssuedAtKey         = "secret_id_issued_at"
+)
+
+// planAppRoleSecretIDs plans the delivery of the role_id and a fresh secret_id of the AppRole roles into
+// their secrets, when the secret is missing, the role_id changed, the secret_id is no longer valid or
+// it is due for the rotation
+func planAppRoleSecretIDs(baseURL, path string, spec common.AuthMethodSpec) ([]VaultChange, error) {
+	var roleNames []string
+	for roleName := range spec.SecretIDDelivery {
+		roleNames = append(roleNames, roleName)
+	}
+	sort.Strings(roleNames)
+
+	var changes []VaultChange
+	for _, roleName := range roleNames {
+		delivery := spec.SecretIDDelivery[roleName]
+		rolePath := "auth/" + path + "/role/" + strings.TrimSpace(roleName)
+		stored, _, err := keyStore.Read(delivery.SecretName)
+		if err != nil && !errors.Is(err, errKeyNotFound) {
+			return nil, fmt.Errorf("error while reading the AppRole secret %s: %w", delivery.SecretName, err)
+		}
+		reason, err := appRoleSecretIDDue(baseURL, rolePath, delivery, stored)
+		if err != nil {
+			return nil, err
+		}
+		if len(reason) == 0 {
+			continue
+		}
+		action := common.ChangeUpdate
+		if stored == nil {
+			action = common.ChangeCreate
+		}
+		changes = append(changes, VaultChange{
+			Kind:    common.ObjectAppRoleSecretID,
+			Name:    path + "/" + strings.TrimSpace(roleName),
+			Action:  action,
+			Current: reason,
+			Desired: delivery.SecretName,
+			apply:   deliverAppRoleSecretIDFunc(baseURL, rolePath, delivery.SecretName, stored),
+		})
+	}
+	return changes, nil
+}
+
+// appRoleSecretIDDue provides the reason the secret_id of the role is to be issued again, empty when the
+// delivered credentials are still good
+func appRoleSecretIDDue(baseURL, rolePath string, delivery common.SecretIDDelivery, stored map[string]string) (string, error) {
+	if stored == nil {
+		return "secret is missing", nil
+	}
+	if len(delivery.RotationPeriod) > 0 {
+		rotationPeriod, _ := time.ParseDuration(delivery.RotationPeriod)
+		issuedAt, err := time.Parse(time.RFC3339, stored[appRoleIssuedAtKey])
+		if err != nil || time.Since(issuedAt) >= rotationPeriod {
+			return "rotation is due", nil
+		}
+	}
+
+	current, err := readVault(baseURL, rolePath+"/role-id")
+	if err != nil {
+		return "", err
+	}
+	if current == nil {
+		// the role is created along with the secret
+		return "role is missing", nil
+	}
+	if roleID, _ := vaultData(current)[appRoleRoleIDKey].(string); roleID != stored[appRoleRoleIDKey] {
+		return "role_id has changed", nil
+	}
+	payload, _ := json.Marshal(map[string]string{"secret_id_accessor": stored[appRoleAccessorKey]})
+	if _, err := FireRequest(string(payload), baseURL+"/v1/"+rolePath+"/secret-id-accessor/lookup", getAuthTokenHeaders(), common.HttpMethodPOST); err != nil {
+		// only the unknown accessor means the secret_id is gone; the other errors, such as a denied lookup,
+		// would issue a new secret_id on every reconcile. Older vault versions report it as a server error.
+		var apiError *VaultAPIError
+		if errors.As(err, &apiError) && (apiError.StatusCode == http.StatusNotFound ||
+			strings.Contains(strings.Join(apiError.Errors, " "), "failed to find accessor entry")) {
+			return "secret_id is no longer valid", nil
+		}
+		return "", fmt.Errorf("error while looking up the secret_id of %s: %w", rolePath, err)
+	}
+	return "", nil
+}
+
+// deliverAppRoleSecretIDFunc provides the issue of a new secret_id of the role and its write, along with the
+// role_id, into the secret. The previous secret_id is kept valid for a rotation period, so the clients reading
+// the secret have the time to pick the new one; the one before it is destroyed.
+func deliverAppRoleSecretIDFunc(baseURL, rolePath, secretName string, stored map[string]string) func() error {
+	return func() error {
+		current, err := readVault(baseURL, rolePath+"/role-id")
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return fmt.Errorf("role %s is not found", rolePath)
+		}
+		roleID, _ := vaultData(current)[appRoleRoleIDKey].(string)
+		response, err := FireRequest("", baseURL+"/v1/"+rolePath+"/secret-id", getAuthTokenHeaders(), common.HttpMethodPOST)
+		if err != nil {
+			return fmt.Errorf("error while issuing the secret_id of %s: %w", rolePath, err)
+		}
+		var secretIDResponse map[string]interface{}
+		if err := parseJSONRespo(response, &secretIDResponse); err != nil {
+			return fmt.Errorf("error while issuing the secret_id of %s: %v", rolePath, err)
+		}
+		secretID, _ := vaultData(secretIDResponse)[appRoleSecretIDKey].(string)
+		accessor, _ := vaultData(secretIDResponse)[appRoleAccessorKey].(string)
+
+		delivered := map[string]string{
+			appRoleRoleIDKey:           roleID,
+			appRoleSecretIDKey:         secretID,
+			appRoleAccessorKey:         accessor,
+			appRolePreviousAccessorKey: stored[appRoleAccessorKey],
+			appRoleIssuedAtKey:         time.Now().UTC().Format(time.RFC3339),
+		}
+		if err := keyStore.Write(secretName, delivered); err != nil {
+			// nobody will ever know the secret_id, it is not left behind valid
+			destroyAppRoleSecretID(baseURL, rolePath, accessor)
+			return fmt.Errorf("error while writing the AppRole secret %s: %w", secretName, err)
+		}
+		log.Infof("Delivered the role_id and a new secret_id of %s into %s", rolePath, secretName)
+		if previous := stored[appRolePreviousAccessorKey]; len(previous) > 0 {
+			destroyAppRoleSecretID(baseURL, rolePath, previous)
+		}
+		return nil
+	}
+}
+
+// destroyAppRoleSecretID destroys the secret_id of the given accessor; the failure is only logged, as the
+// secret_id expires with its TTL anyway
+func destroyAppRoleSecretID(baseURL, rolePath, accessor string) {
+	payload, _ := json.Marshal(map[string]string{"secret_id_accessor": accessor})
+	if _, err := FireRequest(string(payload), baseURL+"/v1/"+rolePath+"/secret-id-accessor/destroy", getAuthTokenHeaders(), common.HttpMethodPOST); err != nil {
+		log.Warnf("error while destroying the secret_id %s of %s: %v", accessor, rolePath, err)
+	}
+}
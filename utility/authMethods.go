@@ -0,0 +1,237 @@
+package utility
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"vault-initializer/common"
+)
+
+// authObjectSegments are the paths the roles, users, groups and certs of an auth method are written under
+var authObjectSegments = []string{"role", "users", "groups", "certs"}
+
+// authMethodSpecs provides the auth methods keyed by their path; the ones declared in authMethods, along
+// with the kubernetes auth of kubernetesAuth and the LDAP auth of the legacy LDAP keys converted into the
+// same form, and the userpass auth of the break-glass admins. A path declared more than once is an error.
+func authMethodSpecs(configData map[string]string) (map[string]common.AuthMethodSpec, error) {
+	specs := make(map[string]common.AuthMethodSpec)
+	if len(strings.TrimSpace(configData["authMethods"])) > 0 {
+		var declared map[string]common.AuthMethodSpec
+		if err := json.Unmarshal([]byte(configData["authMethods"]), &declared); err != nil {
+			return nil, fmt.Errorf("error while un-marshalling the auth methods, err: %v", err)
+		}
+		for path, spec := range declared {
+			specs[strings.Trim(strings.TrimSpace(path), "/")] = spec
+		}
+	}
+	add := func(source, path string, spec common.AuthMethodSpec) error {
+		if _, found := specs[path]; found {
+			return fmt.Errorf("auth method %s is declared both in authMethods and %s", path, source)
+		}
+		specs[path] = spec
+		return nil
+	}
+
+	if len(strings.TrimSpace(configData["kubernetesAuth"])) > 0 {
+		path, spec, err := kubernetesAuthMethod(configData["kubernetesAuth"])
+		if err != nil {
+			return nil, err
+		}
+		if err := add("kubernetesAuth", path, spec); err != nil {
+			return nil, err
+		}
+	}
+	if len(strings.TrimSpace(configData["ldapConfig"])) > 0 {
+		spec, err := ldapAuthMethod(configData)
+		if err != nil {
+			return nil, err
+		}
+		if err := add("ldapConfig", common.LDAPAuthPath, spec); err != nil {
+			return nil, err
+		}
+	}
+	// the userpass method of the break-glass admins may be declared along with its other users
+	breakGlass, err := breakGlassSpec(configData)
+	if err != nil {
+		return nil, err
+	}
+	if breakGlass != nil {
+		if existing, found := specs[breakGlass.Path]; !found {
+			specs[breakGlass.Path] = common.AuthMethodSpec{Type: "userpass", Description: "Break-glass admins"}
+		} else if existing.Type != "userpass" {
+			return nil, fmt.Errorf("auth method %s is declared as %s, but breakGlass needs it to be userpass", breakGlass.Path, existing.Type)
+		}
+	}
+	return specs, nil
+}
+
+// authObjects provides the roles, users, groups and certs of the auth method keyed by their path under the method
+func authObjects(spec common.AuthMethodSpec) map[string]map[string]interface{} {
+	objects := make(map[string]map[string]interface{})
+	for i, section := range []map[string]map[string]interface{}{spec.Roles, spec.Users, spec.Groups, spec.Certs} {
+		for name, payload := range section {
+			objects[authObjectSegments[i]+"/"+strings.TrimSpace(name)] = payload
+		}
+	}
+	return objects
+}
+
+// planAuthMethodsInPod plans the enabling and the tuning of each auth method, the write of its config and
+// the writes of its roles, users, groups and certs
+func planAuthMethodsInPod(baseURL string) ([]VaultChange, error) {
+	specs, err := authMethodSpecs(configMapObject.Data)
+	if err != nil {
+		return nil, err
+	}
+	var changes []VaultChange
+	for _, path := range sortedKeys(specs) {
+		spec := specs[path]
+		planned, err := planMount(baseURL, "sys/auth", path, common.ObjectAuthMethod, authMountPayload(spec))
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, planned...)
+
+		config := spec.Config
+		switch spec.Type {
+		case "kubernetes":
+			if config, err = kubernetesAuthConfig(spec.Config); err != nil {
+				return nil, err
+			}
+		case "jwt", "oidc":
+			if config, err = jwtAuthConfig(spec.Config); err != nil {
+				return nil, err
+			}
+		}
+		if len(config) > 0 {
+			configChange, err := planConfigWrite(baseURL, "auth/"+path+"/config", config)
+			if err != nil {
+				return nil, err
+			}
+			if configChange != nil && spec.Type == "kubernetes" && !kubernetesAuthConfigWritable(config) {
+				configPath := "auth/" + path + "/config"
+				configChange.apply = func() error {
+					return fmt.Errorf("%s is derived from the service account of the initializer, it is only written from the cluster", configPath)
+				}
+			}
+			if configChange != nil {
+				changes = append(changes, *configChange)
+			}
+		}
+
+		objects := authObjects(spec)
+		for _, objectName := range sortedKeys(objects) {
+			change, err := planAuthObject(baseURL, path+"/"+objectName, objects[objectName])
+			if err != nil {
+				return nil, err
+			}
+			if change != nil {
+				changes = append(changes, *change)
+			}
+		}
+
+		if spec.Type == "approle" && len(spec.SecretIDDelivery) > 0 {
+			planned, err := planAppRoleSecretIDs(baseURL, path, spec)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, planned...)
+		}
+	}
+	return changes, nil
+}
+
+// authMountPayload provides the payload of sys/auth/<path>, the tune options go into its config
+func authMountPayload(spec common.AuthMethodSpec) map[string]interface{} {
+	payload := map[string]interface{}{"type": spec.Type}
+	if len(spec.Description) > 0 {
+		payload["description"] = spec.Description
+	}
+	if len(spec.Tune) > 0 {
+		payload["config"] = spec.Tune
+	}
+	if len(spec.Options) > 0 {
+		payload["options"] = spec.Options
+	}
+	return payload
+}
+
+// ldapAuthMethod converts the legacy LDAP keys into the auth method form; enableLDAP gives the mount,
+// ldapConfig the config and the groups and users come from ldapPolicyGroupMappings and ldapPolicyBindings
+func ldapAuthMethod(configData map[string]string) (common.AuthMethodSpec, error) {
+	spec := common.AuthMethodSpec{Type: "ldap", Description: "Login with LDAP"}
+	if len(configData["enableLDAP"]) > 0 {
+		var enablePayload map[string]interface{}
+		if err := json.Unmarshal([]byte(configData["enableLDAP"]), &enablePayload); err != nil {
+			return spec, fmt.Errorf("error while un-marshalling the LDAP enable payload, err: %v", err)
+		}
+		spec.Description, _ = enablePayload["description"].(string)
+		spec.Tune, _ = enablePayload["config"].(map[string]interface{})
+	}
+	if err := json.Unmarshal([]byte(configData["ldapConfig"]), &spec.Config); err != nil {
+		return spec, fmt.Errorf("error while un-marshalling the LDAP config, err: %v", err)
+	}
+
+	bindings, err := ldapPolicyBindings(configData)
+	if err != nil {
+		return spec, err
+	}
+	spec.Groups = make(map[string]map[string]interface{})
+	spec.Users = make(map[string]map[string]interface{})
+	for noun, policies := range bindings["groups"] {
+		spec.Groups[noun] = map[string]interface{}{"policies": stringsToInterfaces(policies)}
+	}
+	for noun, policies := range bindings["users"] {
+		spec.Users[noun] = map[string]interface{}{"policies": stringsToInterfaces(policies)}
+	}
+	return spec, nil
+}
+
+// ldapPolicyBindings provides the policies to be bound to each LDAP group and user, from the r/rw form of
+// ldapPolicyGroupMappings and from ldapPolicyBindings, which lists the policies per group and user
+func ldapPolicyBindings(configData map[string]string) (map[string]map[string][]string, error) {
+	bindings := map[string]map[string][]string{"groups": {}, "users": {}}
+	if len(configData["ldapPolicyGroupMappings"]) > 0 {
+		var policyMappingInterface map[string]map[string][]string
+		if err := json.Unmarshal([]byte(configData["ldapPolicyGroupMappings"]), &policyMappingInterface); err != nil {
+			return nil, fmt.Errorf("error while un-marshalling the policy mappings, err: %v", err)
+		}
+		readPolicies := policyMappingInterface["policies"]["r_policy"]
+		readWritePolicies := policyMappingInterface["policies"]["rw_policy"]
+		for _, binding := range []struct {
+			nouns    []string
+			policies []string
+			kind     string
+		}{
+			{policyMappingInterface["groups"]["r_groups"], readPolicies, "groups"},
+			{policyMappingInterface["groups"]["rw_groups"], readWritePolicies, "groups"},
+			{policyMappingInterface["groups"]["r_users"], readPolicies, "users"},
+			{policyMappingInterface["groups"]["rw_users"], readWritePolicies, "users"},
+		} {
+			for _, noun := range binding.nouns {
+				bindings[binding.kind][strings.TrimSpace(noun)] = binding.policies
+			}
+		}
+	}
+	if len(configData["ldapPolicyBindings"]) > 0 {
+		var policyBindings map[string]map[string][]string
+		if err := json.Unmarshal([]byte(configData["ldapPolicyBindings"]), &policyBindings); err != nil {
+			return nil, fmt.Errorf("error while un-marshalling the policy bindings, err: %v", err)
+		}
+		for _, kind := range []string{"groups", "users"} {
+			for noun, policies := range policyBindings[kind] {
+				bindings[kind][strings.TrimSpace(noun)] = policies
+			}
+		}
+	}
+	return bindings, nil
+}
+
+// stringsToInterfaces converts the list into the form of the lists un-marshalled from JSON
+func stringsToInterfaces(values []string) []interface{} {
+	converted := make([]interface{}, 0, len(values))
+	for _, value := range normalizePolicies(values) {
+		converted = append(converted, value)
+	}
+	return converted
+}
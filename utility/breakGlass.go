@@ -0,0 +1,235 @@
+package utility
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"vault-initializer/common"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// the keys of the secret the credentials of a break-glass admin are written into
+const (
+	breakGlassUsernameKey          = "username"
+	breakGlassPathKey              = "path"
+	breakGlassPasswordKey          = "password"
+	breakGlassEncryptedPasswordKey = "password.asc"
+)
+
+// breakGlassSpec provides the break-glass admins of the config, nil when they are not enabled
+func breakGlassSpec(configData map[string]string) (*common.BreakGlassSpec, error) {
+	if len(strings.TrimSpace(configData["breakGlass"])) == 0 {
+		return nil, nil
+	}
+	var breakGlass common.BreakGlassSpec
+	if err := json.Unmarshal([]byte(configData["breakGlass"]), &breakGlass); err != nil {
+		return nil, fmt.Errorf("error while un-marshalling the break-glass admins, err: %v", err)
+	}
+	breakGlass.Path = strings.Trim(strings.TrimSpace(breakGlass.Path), "/")
+	if len(breakGlass.Path) == 0 {
+		breakGlass.Path = common.BreakGlassAuthPath
+	}
+	return &breakGlass, nil
+}
+
+// breakGlassUserNames provides the names of the break-glass admins, numbered from 1
+func breakGlassUserNames(breakGlass *common.BreakGlassSpec) []string {
+	userNames := make([]string, 0, breakGlass.Users)
+	for i := 1; i <= breakGlass.Users; i++ {
+		userNames = append(userNames, common.BreakGlassUserPrefix+strconv.Itoa(i))
+	}
+	return userNames
+}
+
+// planBreakGlassInPod plans the creation of the missing break-glass admins with the generated passwords, and
+// converges the policy of the existing ones like the other auth objects. The password of an existing admin is
+// never reset here, even when its secret is missing, as the credentials may be kept offline; the missing
+// secret is reported and the password is only rotated on request, by the rotate-break-glass command.
+func planBreakGlassInPod(baseURL string) ([]VaultChange, error) {
+	breakGlass, err := breakGlassSpec(configMapObject.Data)
+	if err != nil || breakGlass == nil {
+		return nil, err
+	}
+	desired := map[string]interface{}{"token_policies": []interface{}{breakGlass.Policy}}
+	var changes []VaultChange
+	for i, userName := range breakGlassUserNames(breakGlass) {
+		objectName := breakGlass.Path + "/users/" + userName
+		secretName := common.BreakGlassSecretPrefix + strconv.Itoa(i+1)
+		current, err := readVault(baseURL, objectPath(common.ObjectAuthObject, objectName))
+		if err != nil {
+			return nil, err
+		}
+
+		if current != nil {
+			if _, _, err := keyStore.Read(secretName); errors.Is(err, errKeyNotFound) {
+				log.Errorf("Secret %s of the break-glass admin %s is missing, the password is left as it is; rotate it with the rotate-break-glass command if it is lost", secretName, userName)
+			} else if err != nil {
+				return nil, fmt.Errorf("error while reading the break-glass secret %s: %w", secretName, err)
+			}
+			differing := differingFields(vaultData(current), desired)
+			if len(differing) == 0 {
+				continue
+			}
+			payload, _ := json.Marshal(desired)
+			changes = append(changes, VaultChange{
+				Kind:    common.ObjectAuthObject,
+				Name:    objectName,
+				Action:  common.ChangeUpdate,
+				Current: differing,
+				Desired: desired,
+				apply:   writeVaultFunc(baseURL+"/v1/"+objectPath(common.ObjectAuthObject, objectName), string(payload), common.HttpMethodPUT),
+			})
+			continue
+		}
+
+		changes = append(changes, VaultChange{
+			Kind:    common.ObjectAuthObject,
+			Name:    objectName,
+			Action:  common.ChangeCreate,
+			Desired: map[string]interface{}{"token_policies": desired["token_policies"], "password": "<generated into " + secretName + ">"},
+			apply:   createBreakGlassAdminFunc(baseURL, breakGlass, userName, secretName, breakGlassPGPKey(breakGlass, i)),
+		})
+	}
+	return changes, nil
+}
+
+// RotateBreakGlassPasswords generates new passwords for the named break-glass admins, all of them when none is
+// named, and writes them into their secrets; the earlier passwords stop working right away. The names of the
+// rotated admins are provided.
+func RotateBreakGlassPasswords(userNames []string) ([]string, error) {
+	defer startTargets()()
+	breakGlass, err := breakGlassSpec(configMapObject.Data)
+	if err != nil {
+		return nil, err
+	}
+	if breakGlass == nil {
+		return nil, fmt.Errorf("no break-glass admins are configured")
+	}
+	_, firstPodIP, err := getFirstResponsivePod()
+	if err != nil {
+		return nil, err
+	}
+	baseURL := podBaseURL(firstPodIP)
+	if err := refreshInitializerAuth(baseURL); err != nil {
+		return nil, err
+	}
+
+	configured := breakGlassUserNames(breakGlass)
+	for _, userName := range userNames {
+		if !containsString(configured, userName) {
+			return nil, fmt.Errorf("%s is not a break-glass admin, they are %s", userName, strings.Join(configured, ", "))
+		}
+	}
+	var rotated []string
+	for i, userName := range configured {
+		if len(userNames) > 0 && !containsString(userNames, userName) {
+			continue
+		}
+		secretName := common.BreakGlassSecretPrefix + strconv.Itoa(i+1)
+		if err := createBreakGlassAdminFunc(baseURL, breakGlass, userName, secretName, breakGlassPGPKey(breakGlass, i))(); err != nil {
+			return rotated, fmt.Errorf("error while rotating the password of %s: %w", userName, err)
+		}
+		rotated = append(rotated, userName)
+	}
+	return rotated, nil
+}
+
+// breakGlassPGPKey provides the name of the pgp key the password of the i-th admin is encrypted for, empty
+// when the passwords are kept in the clear
+func breakGlassPGPKey(breakGlass *common.BreakGlassSpec, i int) string {
+	if len(breakGlass.PGPKeys) > i {
+		return breakGlass.PGPKeys[i]
+	}
+	return ""
+}
+
+// createBreakGlassAdminFunc provides the write of the admin with a generated password, and the write of its
+// credentials into the secret, PGP encrypted for the given key when one is given. The password is lost when
+// the secret cannot be written, it has to be rotated then.
+func createBreakGlassAdminFunc(baseURL string, breakGlass *common.BreakGlassSpec, userName, secretName, pgpKeyName string) func() error {
+	return func() error {
+		password, err := generatePassword()
+		if err != nil {
+			return err
+		}
+		credentials := map[string]string{breakGlassUsernameKey: userName, breakGlassPathKey: breakGlass.Path}
+		if len(pgpKeyName) > 0 {
+			encrypted, err := encryptForPGPKey(pgpKeyName, password)
+			if err != nil {
+				return err
+			}
+			credentials[breakGlassEncryptedPasswordKey] = encrypted
+		} else {
+			credentials[breakGlassPasswordKey] = password
+		}
+
+		payload, _ := json.Marshal(map[string]interface{}{"password": password, "token_policies": []string{breakGlass.Policy}})
+		userPath := objectPath(common.ObjectAuthObject, breakGlass.Path+"/users/"+userName)
+		if _, err := FireRequest(string(payload), baseURL+"/v1/"+userPath, getAuthTokenHeaders(), common.HttpMethodPUT); err != nil {
+			return err
+		}
+		if err := keyStore.Write(secretName, credentials); err != nil {
+			return fmt.Errorf("error while writing the break-glass secret %s, the password of %s has to be rotated: %w", secretName, userName, err)
+		}
+		log.Infof("Credentials of the break-glass admin %s are written into %s", userName, secretName)
+		return nil
+	}
+}
+
+// generatePassword provides a password of 256 random bits
+func generatePassword() (string, error) {
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", fmt.Errorf("error while generating the password: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+// encryptForPGPKey encrypts the value for the named key of the pgpKeysConfigMap / pgpKeysSecret into an
+// armored PGP message; the keybase references cannot be used, as the key is not fetched from keybase
+func encryptForPGPKey(keyName, value string) (string, error) {
+	keySource, err := readPGPKeySource()
+	if err != nil {
+		return "", err
+	}
+	pgpKey, err := resolvePGPKey(keyName, keySource)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(pgpKey, "keybase:") {
+		return "", fmt.Errorf("pgp key %s is a keybase reference, the public key itself is needed", keyName)
+	}
+	binaryKey, _ := base64.StdEncoding.DecodeString(pgpKey)
+	entities, err := openpgp.ReadKeyRing(bytes.NewReader(binaryKey))
+	if err != nil || len(entities) == 0 {
+		return "", fmt.Errorf("error while reading the pgp key %s: %v", keyName, err)
+	}
+
+	var encrypted bytes.Buffer
+	armorWriter, err := armor.Encode(&encrypted, "PGP MESSAGE", nil)
+	if err != nil {
+		return "", err
+	}
+	plainWriter, err := openpgp.Encrypt(armorWriter, entities[:1], nil, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("error while encrypting for the pgp key %s: %v", keyName, err)
+	}
+	if _, err := plainWriter.Write([]byte(value)); err != nil {
+		return "", err
+	}
+	if err := plainWriter.Close(); err != nil {
+		return "", err
+	}
+	if err := armorWriter.Close(); err != nil {
+		return "", err
+	}
+	return encrypted.String(), nil
+}
@@ -0,0 +1,99 @@
+package utility
+
+import (
+	log "github.com/sirupsen/logrus"
+	"vault-initializer/common"
+)
+
+// startTargets starts the target provider for a single pass of a command and tracks the current targets;
+// the returned func stops watching them
+func startTargets() func() {
+	stopCh := make(chan struct{})
+	targets.Start(stopCh)
+	reconcileTrackedPods()
+	return func() { close(stopCh) }
+}
+
+// InitializeVault initializes the vault on the first responsive target and stores the init keys, nothing
+// else is done; a vault that is initialized already is left as it is
+func InitializeVault() error {
+	defer startTargets()()
+	return startInitializingWithIndividualPodIP()
+}
+
+// UnsealVaults makes a single pass over the targets and unseals the sealed ones with the stored keys;
+// provides the state of the targets after the pass
+func UnsealVaults() ([]common.PodState, error) {
+	defer startTargets()()
+	firstPodName, firstPodIP, err := getFirstResponsivePod()
+	if err != nil {
+		return nil, err
+	}
+	if err := detectSealType(firstPodName, firstPodIP); err != nil {
+		return nil, err
+	}
+	checkSealStatus()
+	return trackedPodList(), nil
+}
+
+// ConfigureVault converges the auth methods, the policies and the secret engines to the configuration
+// once; provides the number of the changes applied
+func ConfigureVault() (int, error) {
+	defer startTargets()()
+	return reconcileVaultConfiguration()
+}
+
+// VaultStatus provides the initialization, the seal state, the HA role and the version of every target;
+// the targets which cannot be reached are reported with the error instead of failing the whole status
+func VaultStatus() []common.TargetStatus {
+	defer startTargets()()
+	var statuses []common.TargetStatus
+	for _, podState := range trackedPodList() {
+		statuses = append(statuses, targetStatus(podState))
+	}
+	return statuses
+}
+
+// targetStatus reads the state of a single target from its unauthenticated seal status and leader endpoints
+func targetStatus(podState common.PodState) common.TargetStatus {
+	status := common.TargetStatus{Name: podState.Name, Address: podBaseURL(podState.IP), HARole: "-"}
+	if _, err := probePod(podState.IP); err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Reachable = true
+	sealStatus, err := getSealStatus(podState.IP)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Initialized = sealStatus.Initialized
+	status.Sealed = sealStatus.Sealed
+	status.Version = sealStatus.Version
+	if !sealStatus.Initialized || sealStatus.Sealed {
+		return status
+	}
+
+	leaderResponse, err := FireRequest("", podBaseURL(podState.IP)+"/v1/sys/leader", nil, common.HttpMethodGET)
+	if err != nil {
+		log.Errorf("error while reading the HA state of %s: %v", podState.Name, err)
+		status.Error = err.Error()
+		return status
+	}
+	var leader common.VaultLeaderResp
+	if err := parseJSONRespo(leaderResponse, &leader); err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	switch {
+	case !leader.HAEnabled:
+		status.HARole = common.HARoleStandalone
+	case leader.IsSelf:
+		status.HARole = common.HARoleActive
+	case leader.PerformanceStandby:
+		status.HARole = common.HARolePerformanceStandby
+	default:
+		status.HARole = common.HARoleStandby
+	}
+	return status
+}
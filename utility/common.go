@@ -2,41 +2,81 @@ package utility
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"net/http"
 )
 
-func parseJSONRespo(respJSON []byte, structType interface{}) {
-	if respJSON != nil {
-		json.Unmarshal(respJSON, &structType)
+// parseJSONRespo parses the JSON response into the given struct
+func parseJSONRespo(respJSON []byte, structType interface{}) error {
+	if respJSON == nil {
+		return nil
 	}
-	return
+	if err := json.Unmarshal(respJSON, structType); err != nil {
+		return fmt.Errorf("error while parsing the response: %v", err)
+	}
+	return nil
 }
 
-// FireRequest fires the request based on the parameters to the provided URL
+// FireRequest fires the request based on the parameters to the provided URL. The responses with an error
+// status code are returned as *VaultAPIError along with the body. The retryable failures are retried
+// with the configured retry policy, each attempt bounded by the request timeout.
 func FireRequest(payloadJSON string, url string, reqHeaders map[string]string, method string) ([]byte, error) {
-	var req *http.Request
+	return fireRequestWithRetry(vaultHTTPClient, payloadJSON, url, reqHeaders, method)
+}
+
+// fireRequestWithRetry fires the request with the given http client and the retry policy,
+// the client is given for the vaults other than the pods
+func fireRequestWithRetry(client *http.Client, payloadJSON string, url string, reqHeaders map[string]string, method string) ([]byte, error) {
+	var body []byte
+	err := withRetry(method+" "+url, func(ctx context.Context) error {
+		var callErr error
+		body, callErr = fireRequestWithClient(ctx, client, payloadJSON, url, reqHeaders, method)
+		return callErr
+	})
+	return body, err
+}
+
+// fireRequestWithClient fires a single request with the given http client and context
+func fireRequestWithClient(ctx context.Context, client *http.Client, payloadJSON string, url string, reqHeaders map[string]string, method string) ([]byte, error) {
+	var (
+		req *http.Request
+		err error
+	)
 
 	if len(payloadJSON) > 0 {
-		req, err = http.NewRequest(method, url, bytes.NewBuffer([]byte(payloadJSON)))
-		log.Debugf("JSON String getting passed as payload: %s to the URL %s", payloadJSON, url)
+		req, err = http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer([]byte(payloadJSON)))
+		if err != nil {
+			return nil, err
+		}
+		// the payload is never logged, it carries the key shares, the passwords and the secrets written to the vault
+		log.Debugf("Firing %s %s with a payload", method, url)
 		req.Header.Set("Content-Type", "application/json")
 	} else {
-		log.Debug("No payload to pass")
-		req, err = http.NewRequest(method, url, nil)
+		log.Debugf("Firing %s %s without a payload", method, url)
+		req, err = http.NewRequestWithContext(ctx, method, url, nil)
+		if err != nil {
+			return nil, err
+		}
 	}
 	for key, val := range reqHeaders {
 		req.Header.Set(key, val)
 	}
-	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
 	//log.Debugf("Response body getting returned: %s", string(body))
+	if resp.StatusCode >= http.StatusBadRequest {
+		return body, newVaultAPIError(resp.StatusCode, method, url, body)
+	}
 	return body, nil
 }
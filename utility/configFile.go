@@ -0,0 +1,73 @@
+package utility
+
+import (
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
+	"time"
+	"vault-initializer/common"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+var (
+	initConfigFile string
+)
+
+// ParseInitConfigFile reads the local config file and extracts the values for initialization, for the vaults
+// running outside of kubernetes; kubernetes is connected only when the pods are to be discovered or the keys
+// are to be kept in the secrets
+func ParseInitConfigFile(path string) {
+	initConfigFile = path
+	configMap, err := loadConfigFileRevision(path)
+	if err != nil {
+		log.Fatalf("error while reading the config file %s: %v", path, err)
+	}
+	initConfigMapName = configMap.Name
+	if (targets == nil && len(strings.TrimSpace(configMap.Data["vaultAddresses"])) == 0) || keyStore == nil {
+		ConnectK8s()
+	}
+	parseInitConfig(configMap)
+}
+
+// loadConfigFileRevision loads the config file with its modification time as the revision
+func loadConfigFileRevision(path string) (*v1.ConfigMap, error) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	configMap, err := LoadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	configMap.ResourceVersion = fileInfo.ModTime().UTC().Format(time.RFC3339Nano)
+	return configMap, nil
+}
+
+// startConfigFileWatcher checks the config file for the changes every resync period; a changed revision
+// is handed over to the same reload as the config map revisions
+func startConfigFileWatcher(stopCh <-chan struct{}) {
+	resyncPeriod := time.Duration(common.PodResyncPeriodSeconds) * time.Second
+	lastConfigMap := configMapObject
+	go func() {
+		ticker := time.NewTicker(resyncPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				configMap, err := loadConfigFileRevision(initConfigFile)
+				if err != nil {
+					log.Errorf("error while reading the config file %s, continuing with the last good configuration: %v", initConfigFile, err)
+					continue
+				}
+				if configMap.ResourceVersion != lastConfigMap.ResourceVersion {
+					reloadInitConfig(lastConfigMap, configMap)
+					lastConfigMap = configMap
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	log.Infof("Watching the config file %s for the changes every %v", initConfigFile, resyncPeriod)
+}
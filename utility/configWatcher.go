@@ -0,0 +1,163 @@
+package utility
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"vault-initializer/common"
+
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	pendingConfigMap      *v1.ConfigMap
+	pendingConfigMapMutex sync.Mutex
+
+	// restartRequiredKeys are read only once at the start, as they shape the informers, the servers,
+	// the init request or the stored keys; their changes are reported but not applied
+	restartRequiredKeys = []string{"vaultLabelSelector", "vaultAddresses", "secretShares", "secretThreshold", "recoveryShares",
+		"recoveryThreshold", "podResyncPeriodInSeconds", "statusListenAddress", "statusTLSCertFile", "statusTLSKeyFile",
+		"leaderElectionEnabled", "leaderElectionLeaseName", "vaultScheme", "vaultPort", "vaultCACertSecret",
+		"vaultCACertFile", "vaultClientCertSecret", "vaultClientCertFile", "vaultClientKeyFile", "vaultTLSServerName",
+		"keyWrappingMethod", "keyWrappingKeyFile", "transitAddress", "transitMountPath", "transitKeyName",
+		"transitCACertFile", "pgpKeys", "rootTokenPGPKey", "pgpKeysConfigMap", "pgpKeysSecret", "unsealMode", "revokeRootToken",
+		"initializerTokenPeriod", "initializerAuthPath", "autoUnsealGracePeriodInSeconds"}
+)
+
+// startConfigMapInformer watches the init config map; every revision is validated as soon as it is seen,
+// an invalid one is rejected with a kubernetes event and the last good one is kept. A valid revision
+// is handed over to the routine, which applies it and reconciles the vault on the triggered check.
+func startConfigMapInformer(stopCh <-chan struct{}) {
+	factory := informers.NewSharedInformerFactoryWithOptions(k8s.Clientset, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metaV1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", initConfigMapName).String()
+		}))
+	configMapInformer := factory.Core().V1().ConfigMaps()
+	configMapInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldConfigMap := oldObj.(*v1.ConfigMap)
+			newConfigMap := newObj.(*v1.ConfigMap)
+			if oldConfigMap.ResourceVersion != newConfigMap.ResourceVersion {
+				reloadInitConfig(oldConfigMap, newConfigMap)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			log.Warnf("Config map %s is deleted, continuing with the last good configuration", initConfigMapName)
+		},
+	})
+	factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, configMapInformer.Informer().HasSynced) {
+		log.Fatal("error while syncing the config map informer cache")
+	}
+	log.Infof("Watching the config map %s for the changes", initConfigMapName)
+}
+
+// reloadInitConfig validates the changed config map and queues it to be applied by the routine
+func reloadInitConfig(oldConfigMap, configMap *v1.ConfigMap) {
+	if err := ValidateConfigData(configMap.Data); err != nil {
+		log.Errorf("Rejecting the revision %s of the config map %s, continuing with the last good configuration: %v", configMap.ResourceVersion, configMap.Name, err)
+		recordConfigEvent(configMap, v1.EventTypeWarning, "InvalidConfiguration",
+			fmt.Sprintf("Revision %s is rejected, the last good configuration is kept: %v", configMap.ResourceVersion, err))
+		return
+	}
+	for _, key := range restartRequiredKeys {
+		if configMap.Data[key] != oldConfigMap.Data[key] {
+			log.Warnf("%s of the config map %s is changed, the change takes effect only after a restart", key, configMap.Name)
+			recordConfigEvent(configMap, v1.EventTypeWarning, "RestartRequired",
+				fmt.Sprintf("%s is changed in the revision %s, the change takes effect only after a restart", key, configMap.ResourceVersion))
+		}
+	}
+	pendingConfigMapMutex.Lock()
+	pendingConfigMap = configMap
+	pendingConfigMapMutex.Unlock()
+	log.Infof("Revision %s of the config map %s is accepted, triggering the reconcile", configMap.ResourceVersion, configMap.Name)
+	triggerSealCheck()
+}
+
+// applyPendingConfig applies the last accepted revision of the config map, if any
+func applyPendingConfig() {
+	pendingConfigMapMutex.Lock()
+	configMap := pendingConfigMap
+	pendingConfigMap = nil
+	pendingConfigMapMutex.Unlock()
+	if configMap == nil {
+		return
+	}
+	parseReloadableConfig(configMap)
+	recordConfigEvent(configMap, v1.EventTypeNormal, "ConfigurationApplied",
+		fmt.Sprintf("Revision %s is applied", configMap.ResourceVersion))
+}
+
+// parseReloadableConfig extracts the values which can be changed without a restart; the auth methods,
+// the policies, the secret engines, the retry policy and the pruning are read from the config map itself
+func parseReloadableConfig(configMap *v1.ConfigMap) {
+	configMapObject = configMap
+
+	//	Service Wait time for periodic checks of vault availability
+	if len(configMap.Data["serviceWaitTimeInSeconds"]) > 0 {
+		common.WaitTimeSeconds, err = strconv.Atoi(strings.TrimSpace(configMap.Data["serviceWaitTimeInSeconds"]))
+		if err != nil {
+			log.Warnf("error while parsing the wait time input, defaulting to %v", common.WaitTime)
+			common.WaitTimeSeconds = common.WaitTime
+		}
+	} else {
+		log.Warnf("Wait time is not specified, defaulting to %d", common.WaitTime)
+		common.WaitTimeSeconds = common.WaitTime
+	}
+
+	//	Retry policy for the vault and kubernetes calls
+	parseRetryConfig(configMap.Data)
+
+	//	Pruning of the objects removed from the config map
+	parsePruneConfig(configMap.Data)
+}
+
+// recordConfigEvent records a kubernetes event on the config map, or on the VaultInitialization resource
+// it is converted from, so the outcome of an edit shows up in `kubectl describe`; a failure to record is only logged
+func recordConfigEvent(configMap *v1.ConfigMap, eventType, reason, message string) {
+	// the config file has got nothing to record the events on, the logs are all there is
+	if k8s == nil || len(initConfigFile) > 0 {
+		return
+	}
+	apiVersion, kind := "v1", "ConfigMap"
+	if len(configMap.Kind) > 0 {
+		apiVersion, kind = configMap.APIVersion, configMap.Kind
+	}
+	now := metaV1.NewTime(time.Now())
+	event := &v1.Event{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", configMap.Name, time.Now().UnixNano()),
+			Namespace: configMap.Namespace,
+		},
+		InvolvedObject: v1.ObjectReference{
+			APIVersion:      apiVersion,
+			Kind:            kind,
+			Name:            configMap.Name,
+			Namespace:       configMap.Namespace,
+			UID:             configMap.UID,
+			ResourceVersion: configMap.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Count:          1,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Source:         v1.EventSource{Component: "vault-initializer"},
+	}
+	err := k8sCall("record the config map event", func() error {
+		_, err := k8s.Clientset.CoreV1().Events(configMap.Namespace).Create(event)
+		return err
+	})
+	if err != nil {
+		log.Errorf("error while recording the %s event on the config map %s: %v", reason, configMap.Name, err)
+	}
+}
@@ -0,0 +1,155 @@
+package utility
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"vault-initializer/common"
+)
+
+// GenerateRootToken generates a new root token through the sys/generate-root OTP flow, with the unseal keys,
+// or the recovery keys with an auto-unseal seal, kept in the key store. An attempt in progress is cancelled
+// only when reset is given. With reissue, the root token is used to restore the access of the initializer, its
+// policy and login role or its token, and is revoked right away; nothing is returned then.
+func GenerateRootToken(reset, reissue bool) (string, error) {
+	defer startTargets()()
+	firstPodName, firstPodIP, err := getFirstResponsivePod()
+	if err != nil {
+		return "", err
+	}
+	if err := detectSealType(firstPodName, firstPodIP); err != nil {
+		return "", err
+	}
+	if err := populateParsedKeys(); err != nil {
+		return "", err
+	}
+	if len(parsedKeys.Custodians) > 0 {
+		return "", fmt.Errorf("the shares are PGP encrypted for the custodians, they have to run the generate-root themselves")
+	}
+	keys := parsedKeys.KeysBase64
+	if isAutoUnsealSeal() {
+		keys = parsedKeys.RecoveryKeysBase64
+	}
+	if len(keys) == 0 {
+		return "", fmt.Errorf("no %s keys are kept in the key store", common.SealType)
+	}
+
+	baseURL := podBaseURL(firstPodIP)
+	attemptURL := baseURL + "/v1/sys/generate-root/attempt"
+	status, err := generateRootRequest(attemptURL, "", common.HttpMethodGET)
+	if err != nil {
+		return "", err
+	}
+	if status.Started {
+		if !reset {
+			return "", fmt.Errorf("a generate-root attempt is in progress (nonce %s, %d of %d), give -reset to cancel it", status.Nonce, status.Progress, status.Required)
+		}
+		if _, err := FireRequest("", attemptURL, nil, common.HttpMethodDELETE); err != nil {
+			return "", fmt.Errorf("error while cancelling the generate-root attempt: %w", err)
+		}
+		log.Infof("Generate-root attempt %s is cancelled", status.Nonce)
+	}
+
+	// the older vault versions expect the otp from the client, the newer ones provide it
+	otp := ""
+	startPayload := ""
+	if status.OTPLength == 0 {
+		otpBytes := make([]byte, 16)
+		if _, err := rand.Read(otpBytes); err != nil {
+			return "", fmt.Errorf("error while generating the otp: %v", err)
+		}
+		otp = base64.StdEncoding.EncodeToString(otpBytes)
+		payload, _ := json.Marshal(map[string]string{"otp": otp})
+		startPayload = string(payload)
+	}
+	status, err = generateRootRequest(attemptURL, startPayload, common.HttpMethodPUT)
+	if err != nil {
+		return "", err
+	}
+	if len(otp) == 0 {
+		otp = status.OTP
+	}
+
+	for _, key := range keys {
+		if status.Complete {
+			break
+		}
+		payload, _ := json.Marshal(map[string]string{"key": key, "nonce": status.Nonce})
+		status, err = generateRootRequest(baseURL+"/v1/sys/generate-root/update", string(payload), common.HttpMethodPUT)
+		if err != nil {
+			return "", err
+		}
+	}
+	if !status.Complete {
+		return "", fmt.Errorf("generate-root is not complete, %d of %d keys are given", status.Progress, status.Required)
+	}
+	rootToken, err := decodeGeneratedRoot(status, otp)
+	if err != nil {
+		return "", err
+	}
+	log.Infof("Root token is generated on the pod %s", firstPodName)
+	if !reissue {
+		return rootToken, nil
+	}
+
+	if err := issueInitializerAccess(baseURL, rootToken); err != nil {
+		if revokeErr := revokeToken(baseURL, rootToken); revokeErr != nil {
+			log.Errorf("error while revoking the generated root token, revoke it by hand: %v", revokeErr)
+		}
+		return "", err
+	}
+	if err := revokeToken(baseURL, rootToken); err != nil {
+		return "", fmt.Errorf("initializer access is restored, but the generated root token cannot be revoked: %w", err)
+	}
+	return "", nil
+}
+
+// generateRootRequest sends the unauthenticated generate-root request and provides the progress of the attempt
+func generateRootRequest(url, payload, method string) (common.VaultGenerateRootResp, error) {
+	var status common.VaultGenerateRootResp
+	response, err := FireRequest(payload, url, nil, method)
+	if err != nil {
+		return status, fmt.Errorf("error while generating the root token: %w", err)
+	}
+	if err := parseJSONRespo(response, &status); err != nil {
+		return status, fmt.Errorf("error while generating the root token: %v", err)
+	}
+	return status, nil
+}
+
+// decodeGeneratedRoot decodes the encoded token of the completed attempt with the otp; the newer vault
+// versions XOR the token with the otp itself, the older ones XOR the UUID bytes with the decoded otp
+func decodeGeneratedRoot(status common.VaultGenerateRootResp, otp string) (string, error) {
+	if len(status.EncodedToken) == 0 {
+		encoded, err := base64.StdEncoding.DecodeString(status.EncodedRootToken)
+		if err != nil {
+			return "", fmt.Errorf("error while decoding the generated root token: %v", err)
+		}
+		otpBytes, err := base64.StdEncoding.DecodeString(otp)
+		if err != nil || len(otpBytes) != len(encoded) || len(encoded) != 16 {
+			return "", fmt.Errorf("generated root token does not match the otp")
+		}
+		token := xorBytes(encoded, otpBytes)
+		return fmt.Sprintf("%x-%x-%x-%x-%x", token[0:4], token[4:6], token[6:8], token[8:10], token[10:16]), nil
+	}
+	encoded, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(status.EncodedToken, "="))
+	if err != nil {
+		return "", fmt.Errorf("error while decoding the generated root token: %v", err)
+	}
+	if len(encoded) != len(otp) {
+		return "", fmt.Errorf("generated root token does not match the otp")
+	}
+	return string(xorBytes(encoded, []byte(otp))), nil
+}
+
+// xorBytes provides the XOR of the equally long byte slices
+func xorBytes(a, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+	return result
+}
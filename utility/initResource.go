@@ -0,0 +1,266 @@
+package utility
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"sync"
+	"time"
+	"vault-initializer/common"
+
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	dynamicClient    dynamic.Interface
+	initResourceName string
+	vaultInitialized bool
+
+	lastReconcile      *common.ReconcileResult
+	lastReconcileMutex sync.Mutex
+
+	vaultInitializationResource = schema.GroupVersionResource{
+		Group:    common.ResourceGroup,
+		Version:  common.ResourceVersion,
+		Resource: common.ResourcePlural,
+	}
+)
+
+// ParseInitResource reads the VaultInitialization resource and extracts the values for initialization;
+// the spec is converted into the config map form, so both the inputs share the same handling
+func ParseInitResource(resourceName string) {
+	initResourceName = resourceName
+	initConfigMapName = resourceName
+	connectDynamicClient()
+	var resource *unstructured.Unstructured
+	err = k8sCall("get the vault initialization resource", func() error {
+		var err error
+		resource, err = dynamicClient.Resource(vaultInitializationResource).Namespace(namespace).Get(resourceName, metaV1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		log.Fatalf("error while accessing the %s %s in %s namespace: %v", common.ResourceKind, resourceName, namespace, err)
+	}
+	initConfigMap, err := resourceConfigMap(resource, true)
+	if err != nil {
+		log.Fatalf("invalid %s %s: %v", common.ResourceKind, resourceName, err)
+	}
+	parseInitConfig(initConfigMap)
+}
+
+// connectDynamicClient builds the dynamic client with the configuration of the kubernetes client
+func connectDynamicClient() {
+	dynamicClient, err = dynamic.NewForConfig(k8sConfig)
+	if err != nil {
+		log.Fatalf("error while connecting the dynamic client: %v", err)
+	}
+}
+
+// resourceConfigMap converts the VaultInitialization resource into the config map form; the
+// policies become the *.hcl keys, the bindings ldapPolicyBindings and the options are kept as they are.
+// The bind password is read from its secret only when resolveSecrets is set.
+func resourceConfigMap(resource *unstructured.Unstructured, resolveSecrets bool) (*v1.ConfigMap, error) {
+	specJSON, err := json.Marshal(resource.Object["spec"])
+	if err != nil {
+		return nil, fmt.Errorf("error while reading the spec: %v", err)
+	}
+	var spec common.VaultInitializationSpec
+	if err := json.Unmarshal(specJSON, &spec); err != nil {
+		return nil, fmt.Errorf("error while un-marshalling the spec: %v", err)
+	}
+
+	configData := make(map[string]string)
+	for key, value := range spec.Options {
+		configData[key] = value
+	}
+	configData["vaultLabelSelector"] = spec.VaultLabelSelector
+	for key, value := range map[string]int{"secretShares": spec.SecretShares, "secretThreshold": spec.SecretThreshold,
+		"recoveryShares": spec.RecoveryShares, "recoveryThreshold": spec.RecoveryThreshold} {
+		if value > 0 {
+			configData[key] = strconv.Itoa(value)
+		}
+	}
+	for name, policyHCL := range spec.Policies {
+		configData[name+".hcl"] = policyHCL
+	}
+	if len(spec.SecretEngines) > 0 {
+		secretEnginesJSON, _ := json.Marshal(spec.SecretEngines)
+		configData["secretEngines"] = string(secretEnginesJSON)
+	}
+
+	if len(spec.AuthMethods) > 0 {
+		authMethodsJSON, _ := json.Marshal(spec.AuthMethods)
+		configData["authMethods"] = string(authMethodsJSON)
+	}
+	if spec.KubernetesAuth != nil {
+		kubernetesAuthJSON, _ := json.Marshal(spec.KubernetesAuth)
+		configData["kubernetesAuth"] = string(kubernetesAuthJSON)
+	}
+	if spec.BreakGlass != nil {
+		breakGlassJSON, _ := json.Marshal(spec.BreakGlass)
+		configData["breakGlass"] = string(breakGlassJSON)
+	}
+
+	if len(spec.LDAP.Enable) > 0 {
+		enableJSON, _ := json.Marshal(spec.LDAP.Enable)
+		configData["enableLDAP"] = string(enableJSON)
+	}
+	if spec.LDAP.BindPassSecret != nil && resolveSecrets {
+		bindPass, err := readSecretKey(*spec.LDAP.BindPassSecret)
+		if err != nil {
+			return nil, err
+		}
+		if spec.LDAP.Config == nil {
+			spec.LDAP.Config = make(map[string]interface{})
+		}
+		spec.LDAP.Config["bindpass"] = bindPass
+	}
+	if len(spec.LDAP.Config) > 0 {
+		configJSON, _ := json.Marshal(spec.LDAP.Config)
+		configData["ldapConfig"] = string(configJSON)
+	}
+	if len(spec.LDAP.Groups) > 0 || len(spec.LDAP.Users) > 0 {
+		bindingsJSON, _ := json.Marshal(map[string]map[string][]string{"groups": spec.LDAP.Groups, "users": spec.LDAP.Users})
+		configData["ldapPolicyBindings"] = string(bindingsJSON)
+	}
+
+	return &v1.ConfigMap{
+		TypeMeta: metaV1.TypeMeta{
+			APIVersion: resource.GetAPIVersion(),
+			Kind:       resource.GetKind(),
+		},
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:            resource.GetName(),
+			Namespace:       resource.GetNamespace(),
+			UID:             resource.GetUID(),
+			ResourceVersion: resource.GetResourceVersion(),
+			Generation:      resource.GetGeneration(),
+		},
+		Data: configData,
+	}, nil
+}
+
+// readSecretKey reads the value of the given key of the secret
+func readSecretKey(ref common.SecretKeyRef) (string, error) {
+	var secret *v1.Secret
+	err := k8sCall("get the secret "+ref.Name, func() error {
+		var err error
+		secret, err = k8s.Clientset.CoreV1().Secrets(namespace).Get(ref.Name, metaV1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("error while reading the secret %s: %w", ref.Name, err)
+	}
+	value, found := secret.Data[ref.Key]
+	if !found {
+		return "", fmt.Errorf("key %s not found in the secret %s", ref.Key, ref.Name)
+	}
+	return string(value), nil
+}
+
+// startResourceInformer watches the VaultInitialization resource; its revisions are converted and handed
+// over to the same reload as the config map revisions
+func startResourceInformer(stopCh <-chan struct{}) {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynamicClient, 0, namespace, func(options *metaV1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("metadata.name", initResourceName).String()
+	})
+	resourceInformer := factory.ForResource(vaultInitializationResource).Informer()
+	resourceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldResource := oldObj.(*unstructured.Unstructured)
+			newResource := newObj.(*unstructured.Unstructured)
+			// the status updates do not change the generation
+			if oldResource.GetGeneration() == newResource.GetGeneration() {
+				return
+			}
+			oldConfigMap, _ := resourceConfigMap(oldResource, false)
+			newConfigMap, err := resourceConfigMap(newResource, true)
+			if err != nil {
+				log.Errorf("Rejecting the generation %d of the %s %s: %v", newResource.GetGeneration(), common.ResourceKind, initResourceName, err)
+				recordConfigEvent(configMapObject, v1.EventTypeWarning, "InvalidConfiguration",
+					fmt.Sprintf("Generation %d is rejected, the last good configuration is kept: %v", newResource.GetGeneration(), err))
+				return
+			}
+			if oldConfigMap == nil {
+				oldConfigMap = configMapObject
+			}
+			reloadInitConfig(oldConfigMap, newConfigMap)
+		},
+		DeleteFunc: func(obj interface{}) {
+			log.Warnf("%s %s is deleted, continuing with the last good configuration", common.ResourceKind, initResourceName)
+		},
+	})
+	factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, resourceInformer.HasSynced) {
+		log.Fatal("error while syncing the vault initialization informer cache")
+	}
+	log.Infof("Watching the %s %s for the changes", common.ResourceKind, initResourceName)
+}
+
+// startConfigInformer watches the configuration source, the VaultInitialization resource, the config file
+// or the config map
+func startConfigInformer(stopCh <-chan struct{}) {
+	if len(initConfigFile) > 0 {
+		startConfigFileWatcher(stopCh)
+	} else if len(initResourceName) > 0 {
+		startResourceInformer(stopCh)
+	} else {
+		startConfigMapInformer(stopCh)
+	}
+}
+
+// recordReconcileResult keeps the outcome of the last reconcile of the vault configuration
+func recordReconcileResult(changes int, reconcileErr error) {
+	result := &common.ReconcileResult{Time: time.Now(), Result: common.ReconcileSuccess, Changes: changes}
+	if reconcileErr != nil {
+		result.Result = common.ReconcileFailure
+		result.Message = reconcileErr.Error()
+	}
+	lastReconcileMutex.Lock()
+	lastReconcile = result
+	lastReconcileMutex.Unlock()
+}
+
+// reportResourceStatus writes the initialization, the seal state of each pod and the last reconcile
+// result into the status of the VaultInitialization resource; nothing is done for the config map
+func reportResourceStatus() {
+	if len(initResourceName) == 0 {
+		return
+	}
+	lastReconcileMutex.Lock()
+	status := common.VaultInitializationStatus{
+		ObservedGeneration: configMapObject.Generation,
+		Initialized:        vaultInitialized,
+		SealType:           common.SealType,
+		Pods:               trackedPodList(),
+		LastReconcile:      lastReconcile,
+	}
+	lastReconcileMutex.Unlock()
+	statusJSON, _ := json.Marshal(status)
+	var statusObject map[string]interface{}
+	if err := json.Unmarshal(statusJSON, &statusObject); err != nil {
+		log.Errorf("error while converting the status of the %s %s: %v", common.ResourceKind, initResourceName, err)
+		return
+	}
+
+	err := k8sCall("update the vault initialization status", func() error {
+		resource, err := dynamicClient.Resource(vaultInitializationResource).Namespace(namespace).Get(initResourceName, metaV1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		resource.Object["status"] = statusObject
+		_, err = dynamicClient.Resource(vaultInitializationResource).Namespace(namespace).UpdateStatus(resource, metaV1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		log.Errorf("error while updating the status of the %s %s: %v", common.ResourceKind, initResourceName, err)
+	}
+}
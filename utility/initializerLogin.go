@@ -0,0 +1,212 @@
+package utility
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"vault-initializer/common"
+)
+
+// errNoAuthToken is the failure of the initializer to find any token to configure the vault with
+var errNoAuthToken = errors.New("no usable token to configure the vault")
+
+var (
+	initializerAuthPath string
+	loginToken          string
+	loginTokenExpiry    time.Time
+)
+
+// initializerPolicyManaged returns true when the initializer works with the vault-initializer policy instead
+// of the root token, either through its own token or through the kubernetes login
+func initializerPolicyManaged() bool {
+	return revokeRootToken || len(initializerAuthPath) > 0
+}
+
+// initializerPolicyHCL provides the policy of the initializer; the policies, the auth methods and the secret
+// engines, and only the paths of the auth methods it manages, those declared and those it still owns, so
+// the removed ones can be pruned
+func initializerPolicyHCL() (string, error) {
+	specs, err := authMethodSpecs(configMapObject.Data)
+	if err != nil {
+		return "", err
+	}
+	owned, err := readManagedObjects()
+	if err != nil {
+		return "", err
+	}
+	authPaths := make(map[string]bool)
+	for path := range specs {
+		authPaths[path] = true
+	}
+	for _, path := range owned[managedObjectKeys[common.ObjectAuthMethod]] {
+		authPaths[path] = true
+	}
+	for _, name := range owned[managedObjectKeys[common.ObjectAuthObject]] {
+		for _, segment := range authObjectSegments {
+			if index := strings.Index(name, "/"+segment+"/"); index > 0 {
+				authPaths[name[:index]] = true
+				break
+			}
+		}
+	}
+	sortedPaths := make([]string, 0, len(authPaths))
+	for path := range authPaths {
+		sortedPaths = append(sortedPaths, path)
+	}
+	sort.Strings(sortedPaths)
+
+	var policy strings.Builder
+	policy.WriteString(`# written by the vault-initializer for its own access
+path "sys/policy/*" {
+  capabilities = ["create", "read", "update", "delete", "list"]
+}
+path "sys/auth" {
+  capabilities = ["read"]
+}
+path "sys/auth/*" {
+  capabilities = ["create", "read", "update", "delete", "sudo"]
+}
+path "sys/mounts" {
+  capabilities = ["read"]
+}
+path "sys/mounts/*" {
+  capabilities = ["create", "read", "update", "delete"]
+}
+`)
+	for _, path := range sortedPaths {
+		fmt.Fprintf(&policy, "path \"auth/%s/*\" {\n  capabilities = [\"create\", \"read\", \"update\", \"delete\", \"list\"]\n}\n", path)
+	}
+	return policy.String(), nil
+}
+
+// planInitializerLoginInPod plans the write of the kubernetes auth role the initializer logs in with, bound to
+// its own service account and to the vault-initializer policy
+func planInitializerLoginInPod(baseURL string) ([]VaultChange, error) {
+	if len(initializerAuthPath) == 0 {
+		return nil, nil
+	}
+	role, err := initializerRole()
+	if err != nil {
+		return nil, err
+	}
+	change, err := planAuthObject(baseURL, initializerRoleName(), role)
+	if err != nil || change == nil {
+		return nil, err
+	}
+	return []VaultChange{*change}, nil
+}
+
+// initializerRoleName provides the name of the login role of the initializer under auth/
+func initializerRoleName() string {
+	return initializerAuthPath + "/role/" + common.InitializerPolicyName
+}
+
+// initializerRole provides the login role of the initializer, bound to the service account it runs with
+func initializerRole() (map[string]interface{}, error) {
+	serviceAccountNamespace, serviceAccountName, err := serviceAccountIdentity()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"bound_service_account_names":      []interface{}{serviceAccountName},
+		"bound_service_account_namespaces": []interface{}{serviceAccountNamespace},
+		"token_policies":                   []interface{}{common.InitializerPolicyName},
+		"token_ttl":                        "1h",
+		"token_max_ttl":                    "1h",
+	}, nil
+}
+
+// serviceAccountIdentity provides the namespace and the name of the service account of the initializer, from
+// the subject of its token
+func serviceAccountIdentity() (string, string, error) {
+	token, err := serviceAccountToken()
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", "", fmt.Errorf("the kubernetes login of the initializer needs it to run with a service account token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", "", fmt.Errorf("error while decoding the service account token: %v", err)
+	}
+	var claims struct {
+		Subject string `json:"sub"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", "", fmt.Errorf("error while decoding the service account token: %v", err)
+	}
+	subject := strings.Split(claims.Subject, ":")
+	if len(subject) != 4 || subject[0] != "system" || subject[1] != "serviceaccount" {
+		return "", "", fmt.Errorf("the service account token is issued for %q, not for a service account", claims.Subject)
+	}
+	return subject[2], subject[3], nil
+}
+
+// kubernetesLogin logs the initializer in through the kubernetes auth with its service account; the token is
+// kept until two thirds of its TTL, then it logs in again
+func kubernetesLogin(baseURL string) (string, error) {
+	if len(loginToken) > 0 && time.Now().Before(loginTokenExpiry) {
+		return loginToken, nil
+	}
+	jwt, err := serviceAccountToken()
+	if err != nil {
+		return "", err
+	}
+	if len(jwt) == 0 {
+		return "", fmt.Errorf("the initializer logs in through auth/%s with its service account, it has none outside of the cluster; give the token in %s", initializerAuthPath, common.VaultTokenEnv)
+	}
+	payload, _ := json.Marshal(map[string]string{"role": common.InitializerPolicyName, "jwt": jwt})
+	response, err := FireRequest(string(payload), baseURL+"/v1/auth/"+initializerAuthPath+"/login", nil, common.HttpMethodPOST)
+	if err != nil {
+		return "", fmt.Errorf("error while logging in through auth/%s: %w", initializerAuthPath, err)
+	}
+	var loginResponse struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	if err := parseJSONRespo(response, &loginResponse); err != nil {
+		return "", fmt.Errorf("error while logging in through auth/%s: %v", initializerAuthPath, err)
+	}
+	loginToken = loginResponse.Auth.ClientToken
+	loginTokenExpiry = time.Now().Add(time.Duration(loginResponse.Auth.LeaseDuration) * time.Second * 2 / 3)
+	log.Debugf("Initializer is logged in through auth/%s until %v", initializerAuthPath, loginTokenExpiry)
+	return loginToken, nil
+}
+
+// refreshInitializerAuth prepares the token of the initializer ahead of a reconcile; it logs in through the
+// kubernetes auth, or renews its own token, unless the token is given in VAULT_TOKEN. Until the bootstrap
+// writes the login role, the login fails and the root token is used instead. errNoAuthToken is returned when
+// no token is left to use.
+func refreshInitializerAuth(baseURL string) error {
+	if len(os.Getenv(common.VaultTokenEnv)) > 0 {
+		return nil
+	}
+	var loginErr error
+	if len(initializerAuthPath) > 0 {
+		if _, loginErr = kubernetesLogin(baseURL); loginErr == nil {
+			return nil
+		}
+		loginToken = ""
+		log.Debugf("Initializer cannot log in yet, the root or the initializer token is used: %v", loginErr)
+	}
+	if err := renewInitializerToken(baseURL); err != nil {
+		return err
+	}
+	if _, err := authToken(); err != nil {
+		if loginErr != nil {
+			return fmt.Errorf("%w: %v; %v", errNoAuthToken, loginErr, err)
+		}
+		return fmt.Errorf("%w: %v", errNoAuthToken, err)
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package utility
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"vault-initializer/common"
+)
+
+// initializerTokenKey is the key of the initializer token entry holding the wrapped token and accessor
+const initializerTokenKey = "initializer-token"
+
+var (
+	revokeRootToken        bool
+	initializerTokenPeriod string
+	initializerToken       string
+)
+
+// parseInitializerTokenConfig extracts the revocation of the root token after the bootstrap, the kubernetes
+// auth the initializer logs in with and the period of the initializer token replacing the root token otherwise
+func parseInitializerTokenConfig(configData map[string]string) {
+	revokeRootToken = true
+	if len(configData["revokeRootToken"]) > 0 {
+		revokeRootToken, err = strconv.ParseBool(strings.TrimSpace(configData["revokeRootToken"]))
+		if err != nil {
+			log.Warnf("error while parsing the root token revocation input, defaulting to enabled")
+			revokeRootToken = true
+		}
+	}
+	initializerAuthPath = strings.Trim(strings.TrimSpace(configData["initializerAuthPath"]), "/")
+	initializerTokenPeriod = strings.TrimSpace(configData["initializerTokenPeriod"])
+	if _, err := time.ParseDuration(initializerTokenPeriod); err != nil {
+		initializerTokenPeriod = common.DefaultInitializerTokenPeriod
+	}
+}
+
+// loadInitializerToken provides the initializer token from the key store, empty when none is issued yet
+func loadInitializerToken() (string, error) {
+	if len(initializerToken) > 0 {
+		return initializerToken, nil
+	}
+	tokenData, err := readInitializerToken()
+	if err != nil {
+		return "", err
+	}
+	initializerToken = tokenData["token"]
+	return initializerToken, nil
+}
+
+// readInitializerToken provides the token and the accessor of the initializer token, unwrapped like the init
+// keys as the token can write the policies; nil when none is issued yet
+func readInitializerToken() (map[string]string, error) {
+	storedData, annotations, err := keyStore.Read(common.InitializerTokenSecretName)
+	if errors.Is(err, errKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error while reading the initializer token %s: %w", common.InitializerTokenSecretName, err)
+	}
+	tokenJSON, err := unwrapStoredValue(storedData[initializerTokenKey], annotations, "initializer token")
+	if err != nil {
+		return nil, err
+	}
+	var tokenData map[string]string
+	if err := json.Unmarshal(tokenJSON, &tokenData); err != nil {
+		return nil, fmt.Errorf("error while parsing the initializer token %s: %v", common.InitializerTokenSecretName, err)
+	}
+	return tokenData, nil
+}
+
+// storeInitializerToken stores the token and the accessor of the initializer token, wrapped with the configured
+// key wrapping method; the method recorded for an existing entry is kept by the write, so it has to be the same
+func storeInitializerToken(tokenData map[string]string) error {
+	tokenJSON, _ := json.Marshal(tokenData)
+	storedToken, annotations, err := wrapStoredValue(tokenJSON, "initializer token")
+	if err != nil {
+		return err
+	}
+	storedData := map[string]string{initializerTokenKey: storedToken}
+	_, currentAnnotations, err := keyStore.Read(common.InitializerTokenSecretName)
+	if errors.Is(err, errKeyNotFound) {
+		return keyStore.Create(common.InitializerTokenSecretName, storedData, annotations)
+	}
+	if err != nil {
+		return err
+	}
+	if wrappingMethod := storedWrappingMethod(currentAnnotations); wrappingMethod != keyWrapper.Method() {
+		return fmt.Errorf("initializer token: wrapped with %s method, but %s method is configured", wrappingMethod, keyWrapper.Method())
+	}
+	return keyStore.Write(common.InitializerTokenSecretName, storedData)
+}
+
+// handOverFromRootToken replaces the root token with the kubernetes login or the initializer token once the
+// vault is configured; the login is checked, or the initializer token is issued with the root token, then the
+// root token is revoked and dropped from the init keys. A root token given through VAULT_TOKEN is never revoked.
+func handOverFromRootToken(baseURL string) error {
+	if !revokeRootToken || len(os.Getenv(common.VaultTokenEnv)) > 0 {
+		return nil
+	}
+	if parsedKeys.IsEmpty() {
+		if err := populateParsedKeys(); err != nil {
+			return err
+		}
+	}
+	if parsedKeys.RootTokenPGPEncrypted || len(parsedKeys.RootToken) == 0 {
+		return nil
+	}
+	if len(initializerAuthPath) > 0 {
+		if _, err := kubernetesLogin(baseURL); err != nil {
+			return fmt.Errorf("root token is kept, as the initializer cannot log in: %w", err)
+		}
+	} else {
+		token, err := loadInitializerToken()
+		if err != nil {
+			return err
+		}
+		if len(token) == 0 {
+			if err := issueInitializerAccess(baseURL, parsedKeys.RootToken); err != nil {
+				return err
+			}
+		}
+	}
+	if err := revokeToken(baseURL, parsedKeys.RootToken); err != nil {
+		return fmt.Errorf("error while revoking the root token: %w", err)
+	}
+	parsedKeys.RootToken = ""
+	parsedKeys.RootTokenRevoked = true
+	if err := rewriteInitKeys(parsedKeys); err != nil {
+		return fmt.Errorf("root token is revoked, but the init keys cannot be written without it: %w", err)
+	}
+	log.Info("Root token is revoked, the vault is configured with the vault-initializer policy from now on")
+	return nil
+}
+
+// issueInitializerAccess writes the initializer policy with the given root token, along with the login role
+// when the initializer logs in through the kubernetes auth; otherwise it issues the periodic orphan token of
+// the policy, replacing the stored one, and the earlier token is revoked
+func issueInitializerAccess(baseURL, rootToken string) error {
+	rootHeaders := map[string]string{"X-Vault-Token": rootToken}
+	policyHCL, err := initializerPolicyHCL()
+	if err != nil {
+		return err
+	}
+	policyPayload, _ := json.Marshal(map[string]string{"policy": policyHCL})
+	if _, err := FireRequest(string(policyPayload), baseURL+"/v1/sys/policy/"+common.InitializerPolicyName, rootHeaders, common.HttpMethodPUT); err != nil {
+		return fmt.Errorf("error while writing the initializer policy: %w", err)
+	}
+	if len(initializerAuthPath) > 0 {
+		role, err := initializerRole()
+		if err != nil {
+			return err
+		}
+		rolePayload, _ := json.Marshal(role)
+		if _, err := FireRequest(string(rolePayload), baseURL+"/v1/"+objectPath(common.ObjectAuthObject, initializerRoleName()), rootHeaders, common.HttpMethodPUT); err != nil {
+			return fmt.Errorf("error while writing the login role of the initializer: %w", err)
+		}
+		loginToken = ""
+		_, err = kubernetesLogin(baseURL)
+		return err
+	}
+
+	tokenPayload, _ := json.Marshal(map[string]interface{}{
+		"policies":     []string{common.InitializerPolicyName},
+		"period":       initializerTokenPeriod,
+		"renewable":    true,
+		"no_parent":    true,
+		"display_name": common.InitializerPolicyName,
+	})
+	response, err := FireRequest(string(tokenPayload), baseURL+"/v1/auth/token/create", rootHeaders, common.HttpMethodPOST)
+	if err != nil {
+		return fmt.Errorf("error while issuing the initializer token: %w", err)
+	}
+	var tokenResponse struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+			Accessor    string `json:"accessor"`
+		} `json:"auth"`
+	}
+	if err := parseJSONRespo(response, &tokenResponse); err != nil {
+		return fmt.Errorf("error while issuing the initializer token: %v", err)
+	}
+
+	previous, err := readInitializerToken()
+	if err != nil {
+		return err
+	}
+	tokenData := map[string]string{"token": tokenResponse.Auth.ClientToken, "accessor": tokenResponse.Auth.Accessor}
+	if err := storeInitializerToken(tokenData); err != nil {
+		// the token would never be used, it is not left behind valid
+		if revokeErr := revokeToken(baseURL, tokenResponse.Auth.ClientToken); revokeErr != nil {
+			log.Warnf("error while revoking the initializer token not stored: %v", revokeErr)
+		}
+		return fmt.Errorf("error while storing the initializer token %s: %w", common.InitializerTokenSecretName, err)
+	}
+	initializerToken = tokenResponse.Auth.ClientToken
+	log.Infof("Initializer token is issued with the %s policy and kept in %s", common.InitializerPolicyName, common.InitializerTokenSecretName)
+
+	if accessor := previous["accessor"]; len(accessor) > 0 {
+		accessorPayload, _ := json.Marshal(map[string]string{"accessor": accessor})
+		if _, err := FireRequest(string(accessorPayload), baseURL+"/v1/auth/token/revoke-accessor", rootHeaders, common.HttpMethodPOST); err != nil {
+			log.Warnf("error while revoking the earlier initializer token: %v", err)
+		}
+	}
+	return nil
+}
+
+// revokeToken revokes the given token with itself; a token which is no longer valid is taken as revoked
+func revokeToken(baseURL, token string) error {
+	_, err := FireRequest("", baseURL+"/v1/auth/token/revoke-self", map[string]string{"X-Vault-Token": token}, common.HttpMethodPOST)
+	var apiError *VaultAPIError
+	if errors.As(err, &apiError) && apiError.StatusCode == http.StatusForbidden {
+		return nil
+	}
+	return err
+}
+
+// renewInitializerToken renews the initializer token once half of its period has passed, so it never expires
+// while the initializer runs at least once a period
+func renewInitializerToken(baseURL string) error {
+	if len(os.Getenv(common.VaultTokenEnv)) > 0 {
+		return nil
+	}
+	token, err := loadInitializerToken()
+	if err != nil || len(token) == 0 {
+		return err
+	}
+	headers := map[string]string{"X-Vault-Token": token}
+	response, err := FireRequest("", baseURL+"/v1/auth/token/lookup-self", headers, common.HttpMethodGET)
+	var apiError *VaultAPIError
+	if errors.As(err, &apiError) && apiError.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("initializer token is no longer valid, issue it again with the generate-root command: %w", err)
+	}
+	if err != nil {
+		return fmt.Errorf("error while looking up the initializer token: %w", err)
+	}
+	var lookup struct {
+		Data struct {
+			TTL    int `json:"ttl"`
+			Period int `json:"period"`
+		} `json:"data"`
+	}
+	if err := parseJSONRespo(response, &lookup); err != nil {
+		return fmt.Errorf("error while looking up the initializer token: %v", err)
+	}
+	if lookup.Data.TTL > lookup.Data.Period/2 {
+		return nil
+	}
+	if _, err := FireRequest("", baseURL+"/v1/auth/token/renew-self", headers, common.HttpMethodPOST); err != nil {
+		return fmt.Errorf("error while renewing the initializer token: %w", err)
+	}
+	log.Infof("Initializer token is renewed for %s", initializerTokenPeriod)
+	return nil
+}
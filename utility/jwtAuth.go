@@ -0,0 +1,236 @@
+package utility
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"strings"
+)
+
+// jwksFileKey is the key of the jwt and oidc auth config naming a local JWKS file; it is not sent to the
+// vault, the keys of the file are written as jwt_validation_pubkeys instead
+const jwksFileKey = "jwks_file"
+
+// jwtKeySources are the config keys the jwt and oidc auth methods verify the tokens with, exactly one is given
+var jwtKeySources = []string{"oidc_discovery_url", "jwks_url", "jwt_validation_pubkeys", jwksFileKey}
+
+// jsonWebKey is a key of a JWKS document, only the public parts are read
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// jwtAuthConfig provides the config of the jwt and oidc auth methods; the keys of the local JWKS file, when
+// one is named, are converted into the PEM keys of jwt_validation_pubkeys. The file is read on every reconcile,
+// so the rotated keys are written again.
+func jwtAuthConfig(declared map[string]interface{}) (map[string]interface{}, error) {
+	jwksFile, _ := declared[jwksFileKey].(string)
+	if len(jwksFile) == 0 {
+		return declared, nil
+	}
+	publicKeys, err := readJWKSFile(jwksFile)
+	if err != nil {
+		return nil, err
+	}
+	config := make(map[string]interface{}, len(declared))
+	for key, value := range declared {
+		config[key] = value
+	}
+	delete(config, jwksFileKey)
+	config["jwt_validation_pubkeys"] = stringsToInterfaces(publicKeys)
+	return config, nil
+}
+
+// readJWKSFile provides the signing keys of the JWKS file in the PEM form
+func readJWKSFile(path string) ([]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading the JWKS file %s: %v", path, err)
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &jwks); err != nil {
+		return nil, fmt.Errorf("error while un-marshalling the JWKS file %s, err: %v", path, err)
+	}
+	var publicKeys []string
+	for i, key := range jwks.Keys {
+		if key.Use == "enc" {
+			continue
+		}
+		publicKey, err := key.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %d (%s) of the JWKS file %s: %v", i, key.KeyID, path, err)
+		}
+		der, err := x509.MarshalPKIXPublicKey(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("key %d (%s) of the JWKS file %s: %v", i, key.KeyID, path, err)
+		}
+		publicKeys = append(publicKeys, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+	}
+	if len(publicKeys) == 0 {
+		return nil, fmt.Errorf("JWKS file %s has no signing keys", path)
+	}
+	return publicKeys, nil
+}
+
+// publicKey decodes the RSA, EC or Ed25519 public key of the JWK
+func (key jsonWebKey) publicKey() (interface{}, error) {
+	switch key.KeyType {
+	case "RSA":
+		n, err := decodeJWKInt(key.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %v", err)
+		}
+		e, err := decodeJWKInt(key.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, found := curves[key.Curve]
+		if !found {
+			return nil, fmt.Errorf("curve %q is not supported", key.Curve)
+		}
+		x, errX := decodeJWKInt(key.X)
+		y, errY := decodeJWKInt(key.Y)
+		if errX != nil || errY != nil || !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("invalid point on the curve %s", key.Curve)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if key.Curve != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("only the Ed25519 keys of the OKP type are supported")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("key type %q is not supported", key.KeyType)
+}
+
+// decodeJWKInt decodes the base64url big endian number of a JWK
+func decodeJWKInt(value string) (*big.Int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) == 0 {
+		return nil, fmt.Errorf("is empty")
+	}
+	return new(big.Int).SetBytes(decoded), nil
+}
+
+// validateJWTAuth validates the config of a jwt or oidc auth method verifies the tokens with exactly one key
+// source, and its roles are bound as vault expects them to be
+func validateJWTAuth(field string, config map[string]interface{}, roles map[string]map[string]interface{}, fail func(string, string, ...interface{})) {
+	var sources []string
+	for _, key := range jwtKeySources {
+		if _, found := config[key]; found {
+			sources = append(sources, key)
+		}
+	}
+	if len(sources) != 1 {
+		fail(field+".config", "needs exactly one of %s, got %d", strings.Join(jwtKeySources, ", "), len(sources))
+	}
+	for _, key := range []string{"oidc_discovery_url", "jwks_url"} {
+		if value, found := config[key]; found && !isHTTPURL(value) {
+			fail(field+".config."+key, "%v is not a valid http or https URL", value)
+		}
+	}
+	if value, found := config["jwt_validation_pubkeys"]; found {
+		publicKeys, isList := value.([]interface{})
+		if !isList || len(publicKeys) == 0 {
+			fail(field+".config.jwt_validation_pubkeys", "should be a list of the PEM public keys")
+		}
+		for i, publicKey := range publicKeys {
+			block, _ := pem.Decode([]byte(fmt.Sprint(publicKey)))
+			if block == nil {
+				fail(fmt.Sprintf("%s.config.jwt_validation_pubkeys[%d]", field, i), "is not a PEM key")
+			} else if _, err := x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+				fail(fmt.Sprintf("%s.config.jwt_validation_pubkeys[%d]", field, i), "is not a public key: %v", err)
+			}
+		}
+	}
+	if jwksFile, found := config[jwksFileKey]; found {
+		if _, err := readJWKSFile(fmt.Sprint(jwksFile)); err != nil {
+			fail(field+".config."+jwksFileKey, "%v", err)
+		}
+	}
+
+	defaultRoleType := "oidc"
+	if roleType, found := config["default_role_type"]; found {
+		defaultRoleType = fmt.Sprint(roleType)
+	}
+	for _, roleName := range sortedKeys(roles) {
+		role := roles[roleName]
+		roleField := field + ".roles." + roleName
+		roleType := defaultRoleType
+		if value, found := role["role_type"]; found {
+			roleType = fmt.Sprint(value)
+		}
+		if _, found := role["user_claim"]; !found {
+			fail(roleField+".user_claim", "is required")
+		}
+		for _, key := range []string{"bound_claims", "claim_mappings"} {
+			if value, found := role[key]; found {
+				if _, isObject := value.(map[string]interface{}); !isObject {
+					fail(roleField+"."+key, "should be an object")
+				}
+			}
+		}
+		if value, found := role["groups_claim"]; found {
+			if _, isString := value.(string); !isString {
+				fail(roleField+".groups_claim", "should be the name of the claim")
+			}
+		}
+
+		switch roleType {
+		case "oidc":
+			if _, found := config["oidc_discovery_url"]; !found {
+				fail(roleField+".role_type", "oidc roles need the oidc_discovery_url in the config")
+			}
+			redirectURIs, _ := role["allowed_redirect_uris"].([]interface{})
+			if len(redirectURIs) == 0 {
+				fail(roleField+".allowed_redirect_uris", "is required for the oidc roles")
+			}
+			for _, redirectURI := range redirectURIs {
+				if !isHTTPURL(redirectURI) {
+					fail(roleField+".allowed_redirect_uris", "%v is not a valid http or https URL", redirectURI)
+				}
+			}
+		case "jwt":
+			bound := false
+			for _, key := range []string{"bound_audiences", "bound_subject", "bound_claims", "bound_cidrs", "token_bound_cidrs"} {
+				_, found := role[key]
+				bound = bound || found
+			}
+			if !bound {
+				fail(roleField, "jwt roles need at least one of bound_audiences, bound_subject, bound_claims or bound_cidrs")
+			}
+		default:
+			fail(roleField+".role_type", "should be either jwt or oidc, got %q", roleType)
+		}
+	}
+}
+
+// isHTTPURL returns true when the value is an absolute http or https URL
+func isHTTPURL(value interface{}) bool {
+	parsedURL, err := url.Parse(fmt.Sprint(value))
+	return err == nil && (parsedURL.Scheme == "http" || parsedURL.Scheme == "https") && len(parsedURL.Host) > 0
+}
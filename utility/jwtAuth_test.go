@@ -0,0 +1,241 @@
+package utility
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const (
+	jwksFixture           = "testdata/jwks.json"
+	jwtTestDiscoveryURL   = "https://issuer.example.com"
+	jwtTestRedirectURI    = "https://vault.example.com/ui/vault/auth/oidc/oidc/callback"
+	jwtTestUnknownFixture = "testdata/missing.json"
+)
+
+func TestReadJWKSFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		keyTypes []string
+		err      string
+	}{
+		{name: "signing keys, the encryption key skipped", file: jwksFixture, keyTypes: []string{"rsa", "ecdsa", "ed25519"}},
+		{name: "point off the curve", file: "testdata/jwks_off_curve.json", err: "key 1 (ec-off-curve)"},
+		{name: "unsupported curve", file: "testdata/jwks_unsupported_curve.json", err: `curve "secp256k1" is not supported`},
+		{name: "short Ed25519 key", file: "testdata/jwks_short_ed25519.json", err: "only the Ed25519 keys"},
+		{name: "RSA key without exponent", file: "testdata/jwks_rsa_no_exponent.json", err: "invalid exponent"},
+		{name: "symmetric key", file: "testdata/jwks_symmetric.json", err: `key type "oct" is not supported`},
+		{name: "encryption keys only", file: "testdata/jwks_encryption_only.json", err: "has no signing keys"},
+		{name: "malformed document", file: "testdata/jwks_malformed.json", err: "error while un-marshalling the JWKS file"},
+		{name: "missing file", file: jwtTestUnknownFixture, err: "error while reading the JWKS file"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			publicKeys, err := readJWKSFile(test.file)
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected the error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var keyTypes []string
+			for _, publicKey := range publicKeys {
+				keyTypes = append(keyTypes, pemKeyType(t, publicKey))
+			}
+			if !reflect.DeepEqual(keyTypes, test.keyTypes) {
+				t.Fatalf("expected the keys %v, got %v", test.keyTypes, keyTypes)
+			}
+		})
+	}
+}
+
+func TestJWTAuthConfig(t *testing.T) {
+	declared := map[string]interface{}{jwksFileKey: jwksFixture, "bound_issuer": jwtTestDiscoveryURL}
+	config, err := jwtAuthConfig(declared)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, found := config[jwksFileKey]; found {
+		t.Fatalf("%s should not be sent to the vault", jwksFileKey)
+	}
+	if _, found := declared[jwksFileKey]; !found {
+		t.Fatalf("the declared config should be left as it is")
+	}
+	if config["bound_issuer"] != jwtTestDiscoveryURL {
+		t.Fatalf("the declared keys should be kept, got %v", config["bound_issuer"])
+	}
+	publicKeys, _ := config["jwt_validation_pubkeys"].([]interface{})
+	if len(publicKeys) != 3 {
+		t.Fatalf("expected the 3 signing keys of the fixture, got %v", config["jwt_validation_pubkeys"])
+	}
+
+	withoutFile := map[string]interface{}{"jwks_url": jwtTestDiscoveryURL + "/keys"}
+	if config, err := jwtAuthConfig(withoutFile); err != nil || !reflect.DeepEqual(config, withoutFile) {
+		t.Fatalf("the config without a JWKS file should be left as it is, got %v, %v", config, err)
+	}
+}
+
+func TestValidateJWTAuth(t *testing.T) {
+	fixturePEMs, err := readJWKSFile(jwksFixture)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	jwtRole := func(fields map[string]interface{}) map[string]interface{} {
+		role := map[string]interface{}{"role_type": "jwt", "user_claim": "sub", "bound_audiences": []interface{}{"vault"}}
+		for key, value := range fields {
+			if value == nil {
+				delete(role, key)
+			} else {
+				role[key] = value
+			}
+		}
+		return role
+	}
+	withFixture := map[string]interface{}{jwksFileKey: jwksFixture}
+
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+		roles  map[string]map[string]interface{}
+		fields []string
+	}{
+		{
+			name:   "jwt role with the local JWKS file",
+			config: withFixture,
+			roles:  map[string]map[string]interface{}{"ci": jwtRole(nil)},
+		},
+		{
+			name:   "jwt role with the PEM keys of the fixture",
+			config: map[string]interface{}{"jwt_validation_pubkeys": stringsToInterfaces(fixturePEMs)},
+			roles:  map[string]map[string]interface{}{"ci": jwtRole(nil)},
+		},
+		{
+			name:   "oidc role",
+			config: map[string]interface{}{"oidc_discovery_url": jwtTestDiscoveryURL},
+			roles: map[string]map[string]interface{}{"users": {
+				"user_claim": "email", "groups_claim": "groups", "allowed_redirect_uris": []interface{}{jwtTestRedirectURI},
+				"bound_claims": map[string]interface{}{"hd": "example.com"}, "claim_mappings": map[string]interface{}{"name": "name"},
+			}},
+		},
+		{
+			name:   "invalid key in the JWKS file",
+			config: map[string]interface{}{jwksFileKey: "testdata/jwks_off_curve.json"},
+			fields: []string{"authMethods.jwt.config.jwks_file"},
+		},
+		{
+			name:   "missing JWKS file",
+			config: map[string]interface{}{jwksFileKey: jwtTestUnknownFixture},
+			fields: []string{"authMethods.jwt.config.jwks_file"},
+		},
+		{
+			name:   "invalid PEM keys",
+			config: map[string]interface{}{"jwt_validation_pubkeys": []interface{}{fixturePEMs[0], "not a key", "-----BEGIN PUBLIC KEY-----\nAAAA\n-----END PUBLIC KEY-----\n"}},
+			fields: []string{"authMethods.jwt.config.jwt_validation_pubkeys[1]", "authMethods.jwt.config.jwt_validation_pubkeys[2]"},
+		},
+		{
+			name:   "more than one key source",
+			config: map[string]interface{}{jwksFileKey: jwksFixture, "jwks_url": jwtTestDiscoveryURL + "/keys"},
+			fields: []string{"authMethods.jwt.config"},
+		},
+		{
+			name:   "no key source",
+			config: map[string]interface{}{"bound_issuer": jwtTestDiscoveryURL},
+			fields: []string{"authMethods.jwt.config"},
+		},
+		{
+			name:   "invalid discovery URL",
+			config: map[string]interface{}{"oidc_discovery_url": "issuer.example.com"},
+			fields: []string{"authMethods.jwt.config.oidc_discovery_url"},
+		},
+		{
+			name:   "role without the user claim",
+			config: withFixture,
+			roles:  map[string]map[string]interface{}{"ci": jwtRole(map[string]interface{}{"user_claim": nil})},
+			fields: []string{"authMethods.jwt.roles.ci.user_claim"},
+		},
+		{
+			name:   "bound claims and claim mappings which are not objects",
+			config: withFixture,
+			roles: map[string]map[string]interface{}{"ci": jwtRole(map[string]interface{}{
+				"bound_claims": []interface{}{"hd"}, "claim_mappings": "name",
+			})},
+			fields: []string{"authMethods.jwt.roles.ci.bound_claims", "authMethods.jwt.roles.ci.claim_mappings"},
+		},
+		{
+			name:   "groups claim which is not a claim name",
+			config: withFixture,
+			roles:  map[string]map[string]interface{}{"ci": jwtRole(map[string]interface{}{"groups_claim": []interface{}{"groups"}})},
+			fields: []string{"authMethods.jwt.roles.ci.groups_claim"},
+		},
+		{
+			name:   "unbound jwt role",
+			config: withFixture,
+			roles:  map[string]map[string]interface{}{"ci": jwtRole(map[string]interface{}{"bound_audiences": nil})},
+			fields: []string{"authMethods.jwt.roles.ci"},
+		},
+		{
+			name:   "oidc role, the default role type, without discovery and redirect URIs",
+			config: withFixture,
+			roles:  map[string]map[string]interface{}{"users": {"user_claim": "email"}},
+			fields: []string{"authMethods.jwt.roles.users.allowed_redirect_uris", "authMethods.jwt.roles.users.role_type"},
+		},
+		{
+			name:   "oidc role with an invalid redirect URI",
+			config: map[string]interface{}{"oidc_discovery_url": jwtTestDiscoveryURL},
+			roles:  map[string]map[string]interface{}{"users": {"user_claim": "email", "allowed_redirect_uris": []interface{}{"/callback"}}},
+			fields: []string{"authMethods.jwt.roles.users.allowed_redirect_uris"},
+		},
+		{
+			name:   "unknown role type",
+			config: map[string]interface{}{jwksFileKey: jwksFixture, "default_role_type": "saml"},
+			roles:  map[string]map[string]interface{}{"ci": jwtRole(map[string]interface{}{"role_type": nil})},
+			fields: []string{"authMethods.jwt.roles.ci.role_type"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var fields []string
+			validateJWTAuth("authMethods.jwt", test.config, test.roles, func(field, format string, args ...interface{}) {
+				fields = append(fields, field)
+				t.Logf("%s: %s", field, fmt.Sprintf(format, args...))
+			})
+			sort.Strings(fields)
+			if !reflect.DeepEqual(fields, test.fields) {
+				t.Fatalf("expected the failed fields %v, got %v", test.fields, fields)
+			}
+		})
+	}
+}
+
+// pemKeyType parses the PEM public key and provides its type
+func pemKeyType(t *testing.T, publicKey string) string {
+	t.Helper()
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		t.Fatalf("%q is not a PEM key", publicKey)
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("PEM block is not a public key: %v", err)
+	}
+	switch parsed.(type) {
+	case *rsa.PublicKey:
+		return "rsa"
+	case *ecdsa.PublicKey:
+		return "ecdsa"
+	case ed25519.PublicKey:
+		return "ed25519"
+	}
+	return fmt.Sprintf("%T", parsed)
+}
@@ -0,0 +1,166 @@
+package utility
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// KeyStore keeps the init keys, the state and the generated credentials of the initializer
+type KeyStore interface {
+	// Create stores the named entry and fails when it already exists, so the init keys are never overwritten
+	Create(name string, data map[string]string, annotations map[string]string) error
+	// Write creates or replaces the data of the named entry
+	Write(name string, data map[string]string) error
+	// Read provides the data and the annotations of the named entry, errKeyNotFound when it does not exist
+	Read(name string) (data map[string]string, annotations map[string]string, err error)
+}
+
+var (
+	keyStore KeyStore
+
+	errKeyNotFound = errors.New("not found in the key store")
+)
+
+// UseFileKeyStore keeps the entries as JSON files readable only by the owner in the given directory,
+// for the vaults running outside of kubernetes
+func UseFileKeyStore(directory string) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		log.Fatalf("error while creating the key store directory %s: %v", directory, err)
+	}
+	keyStore = fileKeyStore{directory: directory}
+	log.Infof("Init keys and the state are kept in the directory %s", directory)
+}
+
+// secretKeyStore keeps each entry as a kubernetes secret in the namespace of the initializer
+type secretKeyStore struct{}
+
+func (secretKeyStore) Create(name string, data map[string]string, annotations map[string]string) error {
+	return k8sCall("create the secret "+name, func() error {
+		_, err := k8s.Clientset.CoreV1().Secrets(namespace).Create(newStoreSecret(name, data, annotations))
+		return err
+	})
+}
+
+func (secretKeyStore) Write(name string, data map[string]string) error {
+	return k8sCall("store the secret "+name, func() error {
+		secret, err := k8s.Clientset.CoreV1().Secrets(namespace).Get(name, metaV1.GetOptions{})
+		if apiErrors.IsNotFound(err) {
+			_, err = k8s.Clientset.CoreV1().Secrets(namespace).Create(newStoreSecret(name, data, nil))
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		secret.Data = nil
+		secret.StringData = data
+		_, err = k8s.Clientset.CoreV1().Secrets(namespace).Update(secret)
+		return err
+	})
+}
+
+func (secretKeyStore) Read(name string) (map[string]string, map[string]string, error) {
+	var secret *v1.Secret
+	err := k8sCall("get the secret "+name, func() error {
+		var err error
+		secret, err = k8s.Clientset.CoreV1().Secrets(namespace).Get(name, metaV1.GetOptions{})
+		return err
+	})
+	if apiErrors.IsNotFound(err) {
+		return nil, nil, fmt.Errorf("secret %s: %w", name, errKeyNotFound)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	data := make(map[string]string, len(secret.Data))
+	for key, value := range secret.Data {
+		data[key] = string(value)
+	}
+	return data, secret.Annotations, nil
+}
+
+// newStoreSecret provides the secret of the entry, labelled as the init keys secret always was
+func newStoreSecret(name string, data map[string]string, annotations map[string]string) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:        name,
+			Labels:      map[string]string{"app": "vault", "type": strings.TrimPrefix(name, "vault-")},
+			Annotations: annotations,
+		},
+		StringData: data,
+		Type:       v1.SecretTypeOpaque,
+	}
+}
+
+// fileKeyStore keeps each entry as a JSON file in the directory
+type fileKeyStore struct {
+	directory string
+}
+
+// fileKeyStoreEntry is the content of an entry file
+type fileKeyStoreEntry struct {
+	Data        map[string]string `json:"data"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+func (store fileKeyStore) path(name string) string {
+	return filepath.Join(store.directory, name+".json")
+}
+
+func (store fileKeyStore) Create(name string, data map[string]string, annotations map[string]string) error {
+	content, _ := json.MarshalIndent(fileKeyStoreEntry{Data: data, Annotations: annotations}, "", "  ")
+	file, err := os.OpenFile(store.path(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(content)
+	return err
+}
+
+func (store fileKeyStore) Write(name string, data map[string]string) error {
+	_, annotations, err := store.Read(name)
+	if err != nil && !errors.Is(err, errKeyNotFound) {
+		return err
+	}
+	content, _ := json.MarshalIndent(fileKeyStoreEntry{Data: data, Annotations: annotations}, "", "  ")
+	// written aside into a new file, created with 0600 whatever was left by a crash, and renamed, so a crash
+	// never leaves a partially written entry
+	tempFile, err := ioutil.TempFile(store.directory, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(content)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), store.path(name))
+}
+
+func (store fileKeyStore) Read(name string) (map[string]string, map[string]string, error) {
+	content, err := ioutil.ReadFile(store.path(name))
+	if os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("file %s: %w", store.path(name), errKeyNotFound)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var entry fileKeyStoreEntry
+	if err := json.Unmarshal(content, &entry); err != nil {
+		return nil, nil, fmt.Errorf("error while parsing %s: %v", store.path(name), err)
+	}
+	return entry.Data, entry.Annotations, nil
+}
@@ -0,0 +1,140 @@
+package utility
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"vault-initializer/common"
+)
+
+var keyStoreTestAnnotations = map[string]string{common.KeyWrappingAnnotation: common.KeyWrappingKeyFile}
+
+func TestFileKeyStore(t *testing.T) {
+	tests := []struct {
+		name        string
+		setup       func(store fileKeyStore)
+		write       map[string]string
+		data        map[string]string
+		annotations map[string]string
+		err         string
+	}{
+		{
+			name:  "new entry",
+			write: map[string]string{"state": "{}"},
+			data:  map[string]string{"state": "{}"},
+		},
+		{
+			name: "annotations of the created entry kept",
+			setup: func(store fileKeyStore) {
+				store.Create(common.VaultKeysSecretName, map[string]string{"keys": "wrapped"}, keyStoreTestAnnotations)
+			},
+			write:       map[string]string{"keys": "rewrapped"},
+			data:        map[string]string{"keys": "rewrapped"},
+			annotations: keyStoreTestAnnotations,
+		},
+		{
+			name: "earlier data replaced",
+			setup: func(store fileKeyStore) {
+				store.Write(common.VaultKeysSecretName, map[string]string{"keys": "wrapped", "root_token": "s.root"})
+			},
+			write: map[string]string{"keys": "wrapped"},
+			data:  map[string]string{"keys": "wrapped"},
+		},
+		{
+			name: "entry readable by the others",
+			setup: func(store fileKeyStore) {
+				ioutil.WriteFile(store.path(common.VaultKeysSecretName), []byte(`{"data": {"keys": "plain"}}`), 0644)
+			},
+			write: map[string]string{"keys": "wrapped"},
+			data:  map[string]string{"keys": "wrapped"},
+		},
+		{
+			name: "corrupted entry",
+			setup: func(store fileKeyStore) {
+				ioutil.WriteFile(store.path(common.VaultKeysSecretName), []byte(`{"data": {"ke`), 0600)
+			},
+			write: map[string]string{"keys": "wrapped"},
+			err:   "error while parsing",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := keyStoreTestStore(t)
+			defer os.RemoveAll(store.directory)
+			if test.setup != nil {
+				test.setup(store)
+			}
+			err := store.Write(common.VaultKeysSecretName, test.write)
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected the error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			data, annotations, err := store.Read(common.VaultKeysSecretName)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(data, test.data) || !reflect.DeepEqual(annotations, test.annotations) {
+				t.Fatalf("expected %v with the annotations %v, got %v with %v", test.data, test.annotations, data, annotations)
+			}
+			keyStoreTestFiles(t, store, []string{common.VaultKeysSecretName + ".json"})
+		})
+	}
+}
+
+func TestFileKeyStoreCreate(t *testing.T) {
+	store := keyStoreTestStore(t)
+	defer os.RemoveAll(store.directory)
+
+	if _, _, err := store.Read(common.VaultKeysSecretName); !errors.Is(err, errKeyNotFound) {
+		t.Fatalf("expected the entry to be not found, got %v", err)
+	}
+	if err := store.Create(common.VaultKeysSecretName, map[string]string{"keys": "wrapped"}, keyStoreTestAnnotations); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := store.Create(common.VaultKeysSecretName, map[string]string{"keys": "other"}, nil); err == nil {
+		t.Fatalf("the existing entry should never be overwritten")
+	}
+	data, annotations, err := store.Read(common.VaultKeysSecretName)
+	if err != nil || data["keys"] != "wrapped" || !reflect.DeepEqual(annotations, keyStoreTestAnnotations) {
+		t.Fatalf("expected the first entry to be kept, got %v with %v, %v", data, annotations, err)
+	}
+	keyStoreTestFiles(t, store, []string{common.VaultKeysSecretName + ".json"})
+}
+
+// keyStoreTestStore provides a file key store in a temporary directory, removed by the caller
+func keyStoreTestStore(t *testing.T) fileKeyStore {
+	t.Helper()
+	directory, err := ioutil.TempDir("", "key-store")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return fileKeyStore{directory: directory}
+}
+
+// keyStoreTestFiles checks the store holds only the given files, readable by the owner alone
+func keyStoreTestFiles(t *testing.T, store fileKeyStore, expected []string) {
+	t.Helper()
+	files, err := ioutil.ReadDir(store.directory)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+		if mode := file.Mode().Perm(); mode != 0600 {
+			t.Fatalf("expected the mode 0600 of %s, got %o", filepath.Join(store.directory, file.Name()), mode)
+		}
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected the files %v, got %v", expected, names)
+	}
+}
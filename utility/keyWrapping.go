@@ -0,0 +1,284 @@
+package utility
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"vault-initializer/common"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	keyWrapper KeyWrapper
+)
+
+// KeyWrapper wraps the init keys before they are stored into the secret and unwraps them
+// after they are read back, so that the secret read access alone does not expose the vault
+type KeyWrapper interface {
+	// Method is the name of the wrapping method recorded in the secret annotations
+	Method() string
+	// KeyID identifies the wrapping key recorded in the secret annotations, if any
+	KeyID() string
+	Wrap(plainText []byte) ([]byte, error)
+	Unwrap(cipherText []byte) ([]byte, error)
+}
+
+// parseKeyWrappingConfig builds the key wrapper for the configured wrapping method
+func parseKeyWrappingConfig(configData map[string]string) {
+	method := strings.TrimSpace(configData["keyWrappingMethod"])
+	if len(method) == 0 {
+		method = common.KeyWrappingNone
+	}
+	keyWrapper, err = newKeyWrapper(method, configData)
+	if err != nil {
+		log.Fatalf("error while setting up the %s key wrapping: %v", method, err)
+	}
+	log.Infof("Init keys will be wrapped with the %s method", keyWrapper.Method())
+}
+
+// newKeyWrapper provides the key wrapper implementation for the given method
+func newKeyWrapper(method string, configData map[string]string) (KeyWrapper, error) {
+	switch method {
+	case common.KeyWrappingNone:
+		return noneKeyWrapper{}, nil
+	case common.KeyWrappingKeyFile:
+		keyFile := strings.TrimSpace(configData["keyWrappingKeyFile"])
+		if len(keyFile) == 0 {
+			return nil, fmt.Errorf("keyWrappingKeyFile is needed for the %s method", method)
+		}
+		key, err := readSecretBoxKeyFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return secretBoxKeyWrapper{key: key, keyID: keyFile}, nil
+	case common.KeyWrappingPassphrase:
+		passphrase, avail := os.LookupEnv(common.KeyWrappingPassphraseEnv)
+		if !avail || len(passphrase) == 0 {
+			return nil, fmt.Errorf("%s environment variable is needed for the %s method", common.KeyWrappingPassphraseEnv, method)
+		}
+		return passphraseKeyWrapper{passphrase: []byte(passphrase)}, nil
+	case common.KeyWrappingTransit:
+		return newTransitKeyWrapper(configData)
+	default:
+		return nil, fmt.Errorf("keyWrappingMethod %s is not supported, it should be one of %s, %s, %s or %s", method,
+			common.KeyWrappingNone, common.KeyWrappingKeyFile, common.KeyWrappingPassphrase, common.KeyWrappingTransit)
+	}
+}
+
+// noneKeyWrapper keeps the init keys as plain JSON, as it was stored before the wrapping was introduced
+type noneKeyWrapper struct{}
+
+func (noneKeyWrapper) Method() string { return common.KeyWrappingNone }
+
+func (noneKeyWrapper) KeyID() string { return "" }
+
+func (noneKeyWrapper) Wrap(plainText []byte) ([]byte, error) { return plainText, nil }
+
+func (noneKeyWrapper) Unwrap(cipherText []byte) ([]byte, error) { return cipherText, nil }
+
+// secretBoxKeyWrapper seals the init keys with NaCl secretbox using a 32 byte key read from a mounted file
+type secretBoxKeyWrapper struct {
+	key   *[32]byte
+	keyID string
+}
+
+func (w secretBoxKeyWrapper) Method() string { return common.KeyWrappingKeyFile }
+
+func (w secretBoxKeyWrapper) KeyID() string { return w.keyID }
+
+func (w secretBoxKeyWrapper) Wrap(plainText []byte) ([]byte, error) {
+	return secretBoxSeal(w.key, plainText)
+}
+
+func (w secretBoxKeyWrapper) Unwrap(cipherText []byte) ([]byte, error) {
+	return secretBoxOpen(w.key, cipherText)
+}
+
+// passphraseKeyWrapper derives the secretbox key from a passphrase with scrypt; the random salt
+// is prepended to the sealed box so that every wrap uses a different key
+type passphraseKeyWrapper struct {
+	passphrase []byte
+}
+
+func (w passphraseKeyWrapper) Method() string { return common.KeyWrappingPassphrase }
+
+func (w passphraseKeyWrapper) KeyID() string { return "" }
+
+func (w passphraseKeyWrapper) Wrap(plainText []byte) ([]byte, error) {
+	salt := make([]byte, common.ScryptSaltLength)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	key, err := w.deriveKey(salt)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := secretBoxSeal(key, plainText)
+	if err != nil {
+		return nil, err
+	}
+	return append(salt, sealed...), nil
+}
+
+func (w passphraseKeyWrapper) Unwrap(cipherText []byte) ([]byte, error) {
+	if len(cipherText) < common.ScryptSaltLength {
+		return nil, fmt.Errorf("wrapped keys are too short")
+	}
+	key, err := w.deriveKey(cipherText[:common.ScryptSaltLength])
+	if err != nil {
+		return nil, err
+	}
+	return secretBoxOpen(key, cipherText[common.ScryptSaltLength:])
+}
+
+func (w passphraseKeyWrapper) deriveKey(salt []byte) (*[32]byte, error) {
+	derived, err := scrypt.Key(w.passphrase, salt, common.ScryptN, common.ScryptR, common.ScryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	copy(key[:], derived)
+	return &key, nil
+}
+
+// transitKeyWrapper wraps the init keys with the transit secret engine of another vault cluster
+type transitKeyWrapper struct {
+	address   string
+	mountPath string
+	keyName   string
+	token     string
+	client    *http.Client
+}
+
+// newTransitKeyWrapper builds the transit key wrapper from the config map and the TRANSIT_VAULT_TOKEN
+func newTransitKeyWrapper(configData map[string]string) (KeyWrapper, error) {
+	wrapper := transitKeyWrapper{
+		address:   strings.TrimSuffix(strings.TrimSpace(configData["transitAddress"]), "/"),
+		mountPath: strings.Trim(strings.TrimSpace(configData["transitMountPath"]), "/"),
+		keyName:   strings.TrimSpace(configData["transitKeyName"]),
+		token:     os.Getenv(common.TransitTokenEnv),
+	}
+	if len(wrapper.address) == 0 || len(wrapper.keyName) == 0 {
+		return nil, fmt.Errorf("transitAddress and transitKeyName are needed for the %s method", common.KeyWrappingTransit)
+	}
+	if len(wrapper.token) == 0 {
+		return nil, fmt.Errorf("%s environment variable is needed for the %s method", common.TransitTokenEnv, common.KeyWrappingTransit)
+	}
+	if len(wrapper.mountPath) == 0 {
+		wrapper.mountPath = common.DefaultTransitMountPath
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile := strings.TrimSpace(configData["transitCACertFile"]); len(caFile) > 0 {
+		caPEM, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error while reading the transit CA bundle: %v", err)
+		}
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no valid certificates found in the transit CA bundle")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: certPool}
+	}
+	wrapper.client = &http.Client{Transport: transport}
+	return wrapper, nil
+}
+
+func (w transitKeyWrapper) Method() string { return common.KeyWrappingTransit }
+
+func (w transitKeyWrapper) KeyID() string {
+	return w.address + "/v1/" + w.mountPath + "/keys/" + w.keyName
+}
+
+func (w transitKeyWrapper) Wrap(plainText []byte) ([]byte, error) {
+	payload, _ := json.Marshal(map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plainText)})
+	var response struct {
+		Data struct {
+			CipherText string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	if err := w.fire("encrypt", string(payload), &response); err != nil {
+		return nil, err
+	}
+	if len(response.Data.CipherText) == 0 {
+		return nil, fmt.Errorf("no ciphertext returned by the transit engine")
+	}
+	return []byte(response.Data.CipherText), nil
+}
+
+func (w transitKeyWrapper) Unwrap(cipherText []byte) ([]byte, error) {
+	payload, _ := json.Marshal(map[string]string{"ciphertext": string(cipherText)})
+	var response struct {
+		Data struct {
+			PlainText string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := w.fire("decrypt", string(payload), &response); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(response.Data.PlainText)
+}
+
+// fire calls the given transit operation on the remote vault and parses the response
+func (w transitKeyWrapper) fire(operation, payload string, response interface{}) error {
+	url := w.address + "/v1/" + w.mountPath + "/" + operation + "/" + w.keyName
+	body, err := fireRequestWithRetry(w.client, payload, url, map[string]string{"X-Vault-Token": w.token}, common.HttpMethodPUT)
+	if err != nil {
+		return fmt.Errorf("error while calling the transit %s on %s: %w", operation, w.address, err)
+	}
+	if err := json.Unmarshal(body, response); err != nil {
+		return fmt.Errorf("error while parsing the transit %s response: %v", operation, err)
+	}
+	return nil
+}
+
+// readSecretBoxKeyFile reads the 32 byte key, either raw or base64 encoded, from the given file
+func readSecretBoxKeyFile(keyFile string) (*[32]byte, error) {
+	content, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading the key file %s: %v", keyFile, err)
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content))); err == nil && len(decoded) == 32 {
+		content = decoded
+	}
+	if len(content) != 32 {
+		return nil, fmt.Errorf("key file %s should hold a 32 byte key, either raw or base64 encoded", keyFile)
+	}
+	var key [32]byte
+	copy(key[:], content)
+	return &key, nil
+}
+
+// secretBoxSeal seals the plain text with a random nonce prepended to the box
+func secretBoxSeal(key *[32]byte, plainText []byte) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], plainText, &nonce, key), nil
+}
+
+// secretBoxOpen opens the box sealed by secretBoxSeal
+func secretBoxOpen(key *[32]byte, cipherText []byte) ([]byte, error) {
+	if len(cipherText) < 24 {
+		return nil, fmt.Errorf("wrapped keys are too short")
+	}
+	var nonce [24]byte
+	copy(nonce[:], cipherText[:24])
+	plainText, ok := secretbox.Open(nil, cipherText[24:], &nonce, key)
+	if !ok {
+		return nil, fmt.Errorf("error while unwrapping the keys, the key does not match")
+	}
+	return plainText, nil
+}
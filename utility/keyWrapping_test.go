@@ -0,0 +1,242 @@
+package utility
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"vault-initializer/common"
+)
+
+const (
+	keyWrappingTestKeys  = `{"keys":["share-1","share-2","share-3"],"root_token":"s.root"}`
+	keyWrappingTestToken = "s.transit"
+)
+
+func TestKeyWrapperRoundTrip(t *testing.T) {
+	directory := keyWrappingTestDirectory(t)
+	defer os.RemoveAll(directory)
+	transit := newFakeTransit()
+	defer transit.Close()
+	defer setTestEnv(t, map[string]string{common.KeyWrappingPassphraseEnv: "correct horse", common.TransitTokenEnv: keyWrappingTestToken})()
+
+	tests := []struct {
+		name       string
+		method     string
+		configData map[string]string
+		plainText  bool
+	}{
+		{name: "none", method: common.KeyWrappingNone, plainText: true},
+		{name: "raw key file", method: common.KeyWrappingKeyFile, configData: map[string]string{"keyWrappingKeyFile": keyWrappingTestKeyFile(t, directory, "raw", false)}},
+		{name: "base64 key file", method: common.KeyWrappingKeyFile, configData: map[string]string{"keyWrappingKeyFile": keyWrappingTestKeyFile(t, directory, "base64", true)}},
+		{name: "passphrase", method: common.KeyWrappingPassphrase},
+		{name: "transit", method: common.KeyWrappingTransit, configData: map[string]string{"transitAddress": transit.URL + "/", "transitKeyName": "init-keys"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wrapper, err := newKeyWrapper(test.method, test.configData)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if wrapper.Method() != test.method {
+				t.Fatalf("expected the method %s, got %s", test.method, wrapper.Method())
+			}
+			wrapped, err := wrapper.Wrap([]byte(keyWrappingTestKeys))
+			if err != nil {
+				t.Fatalf("unexpected error while wrapping: %v", err)
+			}
+			if exposed := bytes.Contains(wrapped, []byte("share-1")); exposed != test.plainText {
+				t.Fatalf("expected the keys in plain text %v, got %q", test.plainText, wrapped)
+			}
+			unwrapped, err := wrapper.Unwrap(wrapped)
+			if err != nil {
+				t.Fatalf("unexpected error while unwrapping: %v", err)
+			}
+			if string(unwrapped) != keyWrappingTestKeys {
+				t.Fatalf("expected the keys back, got %q", unwrapped)
+			}
+		})
+	}
+}
+
+func TestKeyWrapperWrongKey(t *testing.T) {
+	directory := keyWrappingTestDirectory(t)
+	defer os.RemoveAll(directory)
+	transit := newFakeTransit()
+	defer transit.Close()
+	defer setTestEnv(t, map[string]string{common.TransitTokenEnv: keyWrappingTestToken})()
+
+	keyFileWrapper := func(name string) KeyWrapper {
+		wrapper, err := newKeyWrapper(common.KeyWrappingKeyFile, map[string]string{"keyWrappingKeyFile": keyWrappingTestKeyFile(t, directory, name, false)})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return wrapper
+	}
+	transitWrapper := func(keyName string) KeyWrapper {
+		wrapper, err := newKeyWrapper(common.KeyWrappingTransit, map[string]string{"transitAddress": transit.URL, "transitKeyName": keyName})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return wrapper
+	}
+
+	tests := []struct {
+		name    string
+		wrapper KeyWrapper
+		other   KeyWrapper
+		mangle  func([]byte) []byte
+		err     string
+	}{
+		{name: "other key file", wrapper: keyFileWrapper("first"), other: keyFileWrapper("second"), err: "the key does not match"},
+		{name: "other passphrase", wrapper: passphraseKeyWrapper{passphrase: []byte("correct horse")}, other: passphraseKeyWrapper{passphrase: []byte("battery staple")}, err: "the key does not match"},
+		{name: "other transit key", wrapper: transitWrapper("init-keys"), other: transitWrapper("other-keys"), err: "invalid ciphertext"},
+		{name: "tampered box", wrapper: keyFileWrapper("tampered"), mangle: func(wrapped []byte) []byte {
+			wrapped[len(wrapped)-1] ^= 0xff
+			return wrapped
+		}, err: "the key does not match"},
+		{name: "truncated box", wrapper: keyFileWrapper("truncated"), mangle: func(wrapped []byte) []byte { return wrapped[:10] }, err: "too short"},
+		{name: "truncated salt", wrapper: passphraseKeyWrapper{passphrase: []byte("correct horse")}, mangle: func(wrapped []byte) []byte { return wrapped[:8] }, err: "too short"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wrapped, err := test.wrapper.Wrap([]byte(keyWrappingTestKeys))
+			if err != nil {
+				t.Fatalf("unexpected error while wrapping: %v", err)
+			}
+			unwrapper := test.wrapper
+			if test.other != nil {
+				unwrapper = test.other
+			}
+			if test.mangle != nil {
+				wrapped = test.mangle(wrapped)
+			}
+			unwrapped, err := unwrapper.Unwrap(wrapped)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected the error %q, got %q, %v", test.err, unwrapped, err)
+			}
+		})
+	}
+}
+
+func TestNewKeyWrapper(t *testing.T) {
+	directory := keyWrappingTestDirectory(t)
+	defer os.RemoveAll(directory)
+	shortKeyFile := filepath.Join(directory, "short")
+	if err := ioutil.WriteFile(shortKeyFile, []byte("too short"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer setTestEnv(t, map[string]string{common.KeyWrappingPassphraseEnv: "", common.TransitTokenEnv: ""})()
+
+	tests := []struct {
+		name       string
+		method     string
+		configData map[string]string
+		err        string
+	}{
+		{name: "unknown method", method: "rot13", err: "keyWrappingMethod rot13 is not supported"},
+		{name: "key file not given", method: common.KeyWrappingKeyFile, err: "keyWrappingKeyFile is needed"},
+		{name: "missing key file", method: common.KeyWrappingKeyFile, configData: map[string]string{"keyWrappingKeyFile": filepath.Join(directory, "missing")}, err: "error while reading the key file"},
+		{name: "short key file", method: common.KeyWrappingKeyFile, configData: map[string]string{"keyWrappingKeyFile": shortKeyFile}, err: "should hold a 32 byte key"},
+		{name: "passphrase not given", method: common.KeyWrappingPassphrase, err: common.KeyWrappingPassphraseEnv},
+		{name: "transit key not given", method: common.KeyWrappingTransit, configData: map[string]string{"transitAddress": "https://transit.example.com"}, err: "transitAddress and transitKeyName are needed"},
+		{name: "transit token not given", method: common.KeyWrappingTransit, configData: map[string]string{"transitAddress": "https://transit.example.com", "transitKeyName": "init-keys"}, err: common.TransitTokenEnv},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := newKeyWrapper(test.method, test.configData); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected the error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+// newFakeTransit serves the encrypt and decrypt of the transit engine; the ciphertext names the key it is
+// encrypted with, and is rejected by the other keys
+func newFakeTransit() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != keyWrappingTestToken {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		segments := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/"+common.DefaultTransitMountPath+"/"), "/")
+		if len(segments) != 2 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		operation, keyName := segments[0], segments[1]
+		var request map[string]string
+		json.NewDecoder(r.Body).Decode(&request)
+		prefix := "vault:v1:" + keyName + ":"
+		data := map[string]string{}
+		switch {
+		case operation == "encrypt":
+			data["ciphertext"] = prefix + request["plaintext"]
+		case operation == "decrypt" && strings.HasPrefix(request["ciphertext"], prefix):
+			data["plaintext"] = strings.TrimPrefix(request["ciphertext"], prefix)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":["invalid ciphertext: unable to decrypt"]}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+}
+
+// keyWrappingTestDirectory provides a temporary directory, removed by the caller
+func keyWrappingTestDirectory(t *testing.T) string {
+	t.Helper()
+	directory, err := ioutil.TempDir("", "key-wrapping")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return directory
+}
+
+// keyWrappingTestKeyFile writes a random 32 byte key, raw or base64 encoded, and provides its path
+func keyWrappingTestKeyFile(t *testing.T, directory, name string, encoded bool) string {
+	t.Helper()
+	content := make([]byte, 32)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatalf("error while generating the key: %v", err)
+	}
+	if encoded {
+		content = []byte(base64.StdEncoding.EncodeToString(content) + "\n")
+	}
+	keyFile := filepath.Join(directory, name)
+	if err := ioutil.WriteFile(keyFile, content, 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return keyFile
+}
+
+// setTestEnv sets the environment variables and provides the restore of the earlier values
+func setTestEnv(t *testing.T, values map[string]string) func() {
+	t.Helper()
+	earlier := make(map[string]*string, len(values))
+	for key, value := range values {
+		if earlierValue, avail := os.LookupEnv(key); avail {
+			earlier[key] = &earlierValue
+		} else {
+			earlier[key] = nil
+		}
+		os.Setenv(key, value)
+	}
+	return func() {
+		for key, earlierValue := range earlier {
+			if earlierValue == nil {
+				os.Unsetenv(key)
+			} else {
+				os.Setenv(key, *earlierValue)
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package utility
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"vault-initializer/common"
+)
+
+// kubernetesAuthMethod converts the kubernetesAuth shorthand into the auth method form, mounted at its
+// path or at kubernetes by default
+func kubernetesAuthMethod(kubernetesAuthJSON string) (string, common.AuthMethodSpec, error) {
+	var kubernetesAuth common.KubernetesAuthSpec
+	if err := json.Unmarshal([]byte(kubernetesAuthJSON), &kubernetesAuth); err != nil {
+		return "", common.AuthMethodSpec{}, fmt.Errorf("error while un-marshalling the kubernetes auth, err: %v", err)
+	}
+	path := strings.Trim(strings.TrimSpace(kubernetesAuth.Path), "/")
+	if len(path) == 0 {
+		path = common.KubernetesAuthPath
+	}
+	return path, common.AuthMethodSpec{
+		Type:        "kubernetes",
+		Description: kubernetesAuth.Description,
+		Config:      kubernetesAuth.Config,
+		Roles:       kubernetesAuth.Roles,
+	}, nil
+}
+
+// kubernetesAuthConfig provides the config of the kubernetes auth method; the host, the CA and the token
+// reviewer JWT are those of the service account of the initializer running in the cluster, the declared
+// config takes the precedence. Outside of the cluster nothing is derived, they are left out of the config.
+// The token is read on every reconcile, so the rotated token is written again.
+func kubernetesAuthConfig(declared map[string]interface{}) (map[string]interface{}, error) {
+	config := make(map[string]interface{})
+	if inClusterConfig != nil {
+		config["kubernetes_host"] = inClusterConfig.Host
+		caCert := inClusterConfig.CAData
+		if len(caCert) == 0 && len(inClusterConfig.CAFile) > 0 {
+			var err error
+			caCert, err = ioutil.ReadFile(inClusterConfig.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("error while reading the kubernetes CA: %v", err)
+			}
+		}
+		if len(caCert) > 0 {
+			config["kubernetes_ca_cert"] = string(caCert)
+		}
+		token, err := serviceAccountToken()
+		if err != nil {
+			return nil, err
+		}
+		if len(token) > 0 {
+			config["token_reviewer_jwt"] = token
+		}
+	}
+	for key, value := range declared {
+		config[key] = value
+	}
+	if host, _ := config["kubernetes_host"].(string); len(host) == 0 && !outOfCluster() {
+		return nil, fmt.Errorf("kubernetes_host of the kubernetes auth cannot be derived without kubernetes, give it in the config")
+	}
+	return config, nil
+}
+
+// kubernetesAuthConfigWritable returns true when the config of the kubernetes auth can be written; outside of the
+// cluster the host, the CA and the token reviewer JWT are not derived, so the declared fields are only compared
+// and the config is written from the cluster, unless the host is declared as well
+func kubernetesAuthConfigWritable(config map[string]interface{}) bool {
+	host, _ := config["kubernetes_host"].(string)
+	return len(host) > 0
+}
+
+// serviceAccountToken provides the token of the service account of the initializer, read again on every call
+// as the projected tokens are rotated; empty outside of the cluster
+func serviceAccountToken() (string, error) {
+	if inClusterConfig == nil {
+		return "", nil
+	}
+	if len(inClusterConfig.BearerTokenFile) > 0 {
+		tokenBytes, err := ioutil.ReadFile(inClusterConfig.BearerTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("error while reading the service account token: %v", err)
+		}
+		return strings.TrimSpace(string(tokenBytes)), nil
+	}
+	return inClusterConfig.BearerToken, nil
+}
+
+// outOfCluster returns true when the initializer is connected to kubernetes through a kubeconfig, outside of
+// the cluster, in which case it has no service account of its own to give to the vault
+func outOfCluster() bool {
+	return k8sConfig != nil && inClusterConfig == nil
+}
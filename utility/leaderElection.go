@@ -0,0 +1,101 @@
+package utility
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"time"
+	"vault-initializer/common"
+
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+var (
+	leaderIdentity    string
+	currentLeader     string
+	leaderStatusMutex sync.RWMutex
+)
+
+// RunWithLeaderElection runs the given routine only on the replica holding the lease, so that the
+// replicas never race on sys/init or on creating the init keys secret. The followers keep waiting to
+// take over; the leader exits when the lease is lost, as the routine cannot be safely interrupted and
+// the restarted pod joins back as a follower.
+// When the leader election is disabled, the routine is run straight away.
+func RunWithLeaderElection(routine func()) {
+	leaderIdentity = getLeaderIdentity()
+	if !common.LeaderElectionEnabled {
+		log.Infof("Leader election is disabled, running as %s", leaderIdentity)
+		setCurrentLeader(leaderIdentity)
+		routine()
+		return
+	}
+	if k8s == nil {
+		log.Warnf("Leader election needs kubernetes for the lease, running as %s without it", leaderIdentity)
+		setCurrentLeader(leaderIdentity)
+		routine()
+		return
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metaV1.ObjectMeta{
+			Name:      common.LeaderElectionLeaseName,
+			Namespace: namespace,
+		},
+		Client:     k8s.Clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: leaderIdentity},
+	}
+	log.Infof("Starting the leader election on the lease %s as %s", common.LeaderElectionLeaseName, leaderIdentity)
+	leaderelection.RunOrDie(context.Background(), leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   common.LeaseDuration * time.Second,
+		RenewDeadline:   common.LeaseRenewDeadline * time.Second,
+		RetryPeriod:     common.LeaseRetryPeriod * time.Second,
+		ReleaseOnCancel: true,
+		Name:            common.LeaderElectionLeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.WithField("identity", leaderIdentity).Info("Acquired the leadership, starting the routine")
+				routine()
+			},
+			OnStoppedLeading: func() {
+				log.WithField("identity", leaderIdentity).Fatal("Lost the leadership, exiting to join back as a follower")
+			},
+			OnNewLeader: func(identity string) {
+				setCurrentLeader(identity)
+				if identity != leaderIdentity {
+					log.WithField("identity", leaderIdentity).Infof("%s is the current leader, waiting as a follower", identity)
+				}
+			},
+		},
+	})
+}
+
+// getLeaderIdentity provides the identity of this replica in the election; the pod name is
+// expected to be passed through the downward API as POD_NAME, else the host name is used
+func getLeaderIdentity() string {
+	if podName, avail := os.LookupEnv("POD_NAME"); avail && len(podName) > 0 {
+		return podName
+	}
+	hostName, err := os.Hostname()
+	if err != nil {
+		log.Fatalf("error while obtaining the identity for the leader election: %v", err)
+	}
+	return hostName
+}
+
+// setCurrentLeader records the identity of the current leader
+func setCurrentLeader(identity string) {
+	leaderStatusMutex.Lock()
+	defer leaderStatusMutex.Unlock()
+	currentLeader = identity
+}
+
+// getCurrentLeader returns the identity of the current leader and whether this replica is the leader
+func getCurrentLeader() (string, bool) {
+	leaderStatusMutex.RLock()
+	defer leaderStatusMutex.RUnlock()
+	return currentLeader, len(currentLeader) > 0 && currentLeader == leaderIdentity
+}
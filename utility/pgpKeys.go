@@ -0,0 +1,143 @@
+package utility
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"strings"
+	"vault-initializer/common"
+
+	"golang.org/x/crypto/openpgp/armor"
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	pgpKeyNames         []string
+	rootTokenPGPKeyName string
+	pgpKeysConfigMap    string
+	pgpKeysSecret       string
+)
+
+// parsePGPConfig extracts the custodian PGP keys and the unseal mode from the config map.
+// pgpKeys is a JSON list holding one entry per secret share, each entry is either the name of a key
+// in the pgpKeysConfigMap / pgpKeysSecret holding the public key, or a keybase:<user> reference.
+// As the initializer cannot decrypt the shares, the unseal mode is forced to manual when pgp keys are given.
+func parsePGPConfig(configData map[string]string) {
+	pgpKeysConfigMap = strings.TrimSpace(configData["pgpKeysConfigMap"])
+	pgpKeysSecret = strings.TrimSpace(configData["pgpKeysSecret"])
+	rootTokenPGPKeyName = strings.TrimSpace(configData["rootTokenPGPKey"])
+	pgpKeyNames = nil
+	if len(configData["pgpKeys"]) > 0 {
+		if err := json.Unmarshal([]byte(configData["pgpKeys"]), &pgpKeyNames); err != nil {
+			log.Fatalf("error while un-marshalling the pgp keys, err: %v", err)
+		}
+	}
+
+	common.UnsealMode = common.UnsealModeAuto
+	if len(configData["unsealMode"]) > 0 {
+		common.UnsealMode = strings.ToLower(strings.TrimSpace(configData["unsealMode"]))
+		if common.UnsealMode != common.UnsealModeAuto && common.UnsealMode != common.UnsealModeManual {
+			log.Fatalf("unsealMode %s is not supported, it should be either %s or %s", common.UnsealMode, common.UnsealModeAuto, common.UnsealModeManual)
+		}
+	}
+	if len(pgpKeyNames) > 0 && common.UnsealMode != common.UnsealModeManual {
+		log.Warnf("Unseal shares are PGP encrypted for the custodians, switching to %s unseal mode", common.UnsealModeManual)
+		common.UnsealMode = common.UnsealModeManual
+	}
+	log.Infof("Unseal mode is %s", common.UnsealMode)
+}
+
+// loadPGPKeys resolves the configured pgp key entries into the values accepted by sys/init,
+// which are either the base64 encoded binary public keys or keybase:<user> references
+func loadPGPKeys() (pgpKeys []string, rootTokenPGPKey string, err error) {
+	keySource, err := readPGPKeySource()
+	if err != nil {
+		return nil, "", err
+	}
+	for _, keyName := range pgpKeyNames {
+		pgpKey, err := resolvePGPKey(keyName, keySource)
+		if err != nil {
+			return nil, "", err
+		}
+		pgpKeys = append(pgpKeys, pgpKey)
+	}
+	if len(rootTokenPGPKeyName) > 0 {
+		rootTokenPGPKey, err = resolvePGPKey(rootTokenPGPKeyName, keySource)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return pgpKeys, rootTokenPGPKey, nil
+}
+
+// readPGPKeySource reads the public keys from the configured config map or secret
+func readPGPKeySource() (map[string]string, error) {
+	keySource := make(map[string]string)
+	if (len(pgpKeysConfigMap) > 0 || len(pgpKeysSecret) > 0) && k8s == nil {
+		return nil, fmt.Errorf("pgp keys cannot be read from the config map or the secret without kubernetes, give them in pgpKeys instead")
+	}
+	if len(pgpKeysConfigMap) > 0 {
+		var keysConfigMap *v1.ConfigMap
+		err := k8sCall("get the pgp keys config map", func() error {
+			var err error
+			keysConfigMap, err = k8s.Clientset.CoreV1().ConfigMaps(namespace).Get(pgpKeysConfigMap, metaV1.GetOptions{})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error while reading the pgp keys from config map %s: %w", pgpKeysConfigMap, err)
+		}
+		for keyName, value := range keysConfigMap.Data {
+			keySource[keyName] = value
+		}
+	}
+	if len(pgpKeysSecret) > 0 {
+		var keysSecret *v1.Secret
+		err := k8sCall("get the pgp keys secret", func() error {
+			var err error
+			keysSecret, err = k8s.Clientset.CoreV1().Secrets(namespace).Get(pgpKeysSecret, metaV1.GetOptions{})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error while reading the pgp keys from secret %s: %w", pgpKeysSecret, err)
+		}
+		for keyName, value := range keysSecret.Data {
+			keySource[keyName] = string(value)
+		}
+	}
+	return keySource, nil
+}
+
+// resolvePGPKey converts an armored public key into the base64 encoded binary key, keeps the
+// keybase references and the already base64 encoded keys (as exported by keybase) as they are
+func resolvePGPKey(keyName string, keySource map[string]string) (string, error) {
+	if strings.HasPrefix(keyName, "keybase:") {
+		return keyName, nil
+	}
+	value, found := keySource[keyName]
+	if !found {
+		return "", fmt.Errorf("pgp key %s not found in the configured config map or secret", keyName)
+	}
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "keybase:") {
+		return value, nil
+	}
+	if strings.HasPrefix(value, "-----BEGIN PGP PUBLIC KEY BLOCK-----") {
+		block, err := armor.Decode(bytes.NewBufferString(value))
+		if err != nil {
+			return "", fmt.Errorf("error while decoding the armored pgp key %s: %v", keyName, err)
+		}
+		binaryKey, err := ioutil.ReadAll(block.Body)
+		if err != nil {
+			return "", fmt.Errorf("error while reading the armored pgp key %s: %v", keyName, err)
+		}
+		return base64.StdEncoding.EncodeToString(binaryKey), nil
+	}
+	if _, err := base64.StdEncoding.DecodeString(value); err != nil {
+		return "", fmt.Errorf("pgp key %s is neither armored nor base64 encoded", keyName)
+	}
+	return value, nil
+}
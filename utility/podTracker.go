@@ -0,0 +1,119 @@
+package utility
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+	"vault-initializer/common"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var (
+	trackedPods      = make(map[types.UID]*common.PodState)
+	trackedPodsMutex sync.RWMutex
+)
+
+// reconcileTrackedPods rebuilds the pod tracking state keyed by the pod UID from the target provider.
+// The pods that are deleted or rescheduled are evicted, and an IP address that moved over to a different
+// pod is reported, so that the stale addresses are never used again. The pods which haven't got the IP
+// assigned yet are skipped, the informer will trigger again once they do.
+func reconcileTrackedPods() {
+	runningTargets, err := targets.Targets()
+	if err != nil {
+		log.Errorf("error while listing the vault targets: %v", err)
+		return
+	}
+
+	trackedPodsMutex.Lock()
+	defer trackedPodsMutex.Unlock()
+
+	previousOwnerOfIP := make(map[string]*common.PodState)
+	for _, podState := range trackedPods {
+		previousOwnerOfIP[podState.IP] = podState
+	}
+
+	currentPods := make(map[types.UID]*common.PodState)
+	for _, target := range runningTargets {
+		if previousOwner, found := previousOwnerOfIP[target.IP]; found && previousOwner.UID != target.UID {
+			log.Warnf("IP address %s of pod %s (%s) is now reused by pod %s (%s)", target.IP,
+				previousOwner.Name, previousOwner.UID, target.Name, target.UID)
+		}
+		podState, found := trackedPods[types.UID(target.UID)]
+		if !found {
+			log.Infof("Tracking the new pod %s (%s) with IP %s", target.Name, target.UID, target.IP)
+			podState = &common.PodState{UID: target.UID, Name: target.Name}
+		} else if podState.IP != target.IP {
+			log.Infof("IP address of pod %s (%s) changed from %s to %s", target.Name, target.UID, podState.IP, target.IP)
+		}
+		podState.IP = target.IP
+		currentPods[types.UID(target.UID)] = podState
+	}
+
+	for uid, podState := range trackedPods {
+		if _, found := currentPods[uid]; !found {
+			log.Infof("Evicting the pod %s (%s) with IP %s as it is no longer running", podState.Name, uid, podState.IP)
+		}
+	}
+	trackedPods = currentPods
+	log.Debugf("Tracked pods after reconcile: %v", describeTrackedPods(trackedPods))
+}
+
+// trackedPodList provides a snapshot of the tracked pods sorted by the pod name
+func trackedPodList() []common.PodState {
+	trackedPodsMutex.RLock()
+	defer trackedPodsMutex.RUnlock()
+	podList := make([]common.PodState, 0, len(trackedPods))
+	for _, podState := range trackedPods {
+		podList = append(podList, *podState)
+	}
+	sort.Slice(podList, func(i, j int) bool { return podList[i].Name < podList[j].Name })
+	return podList
+}
+
+// untrackPod evicts the deleted pod from the tracked pods
+func untrackPod(podUID string) {
+	trackedPodsMutex.Lock()
+	defer trackedPodsMutex.Unlock()
+	if podState, found := trackedPods[types.UID(podUID)]; found {
+		log.Infof("Evicting the pod %s (%s) with IP %s as it is deleted", podState.Name, podUID, podState.IP)
+		delete(trackedPods, types.UID(podUID))
+	}
+}
+
+// recordSealStatus records the last observed seal status for the given pod and provides the updated state.
+// With an auto-unseal seal, the pod staying sealed beyond the grace period is flagged as an auto-unseal failure.
+func recordSealStatus(podUID string, sealed bool) common.PodState {
+	trackedPodsMutex.Lock()
+	defer trackedPodsMutex.Unlock()
+	podState, found := trackedPods[types.UID(podUID)]
+	if !found {
+		return common.PodState{UID: podUID, Sealed: sealed}
+	}
+	podState.LastChecked = time.Now()
+	if sealed && (!podState.Sealed || podState.SealedSince.IsZero()) {
+		podState.SealedSince = podState.LastChecked
+	} else if !sealed {
+		podState.SealedSince = time.Time{}
+	}
+	podState.Sealed = sealed
+	podState.AutoUnsealFailure = sealed && isAutoUnsealSeal() &&
+		podState.LastChecked.Sub(podState.SealedSince) > time.Duration(common.AutoUnsealGracePeriodSeconds)*time.Second
+	return *podState
+}
+
+// podOwnsIP confirms with the target provider that the given pod is still running with the given IP,
+// to never send the unseal keys to an unrelated pod that reused the IP in the meantime
+func podOwnsIP(podState common.PodState) bool {
+	return targets.OwnsAddress(podState)
+}
+
+// describeTrackedPods provides a compact name/uid=ip representation of the tracked pods for the debug logs
+func describeTrackedPods(pods map[types.UID]*common.PodState) map[string]string {
+	description := make(map[string]string, len(pods))
+	for uid, podState := range pods {
+		description[podState.Name+"/"+string(uid)] = podState.IP
+	}
+	return description
+}
@@ -0,0 +1,98 @@
+package utility
+
+import (
+	log "github.com/sirupsen/logrus"
+	"time"
+	"vault-initializer/common"
+
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	listersV1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	podLister  listersV1.PodLister
+	podEventCh = make(chan struct{}, 1)
+)
+
+// startPodInformer starts a shared informer on the pods matching the vault label selectors and
+// waits for the cache to be synced. Every time a pod becomes running, gets an IP, restarts its
+// containers or gets resynced, a seal check is triggered through the pod event channel. A deleted
+// pod is evicted from the tracked pods right away, and the check reports it in the status.
+func startPodInformer(stopCh <-chan struct{}) {
+	resyncPeriod := time.Duration(common.PodResyncPeriodSeconds) * time.Second
+	factory := informers.NewSharedInformerFactoryWithOptions(k8s.Clientset, resyncPeriod,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metaV1.ListOptions) {
+			options.LabelSelector = vaultLabelSelectors
+		}))
+	podInformer := factory.Core().V1().Pods()
+	podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			pod := obj.(*v1.Pod)
+			if isPodReachable(pod) {
+				log.Debugf("pod %s is added with IP %s", pod.Name, pod.Status.PodIP)
+				triggerSealCheck()
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPod := oldObj.(*v1.Pod)
+			newPod := newObj.(*v1.Pod)
+			if !isPodReachable(newPod) {
+				return
+			}
+			// same resource version means it is a periodic resync, used as the fallback for the missed events
+			if oldPod.ResourceVersion == newPod.ResourceVersion || !isPodReachable(oldPod) ||
+				oldPod.Status.PodIP != newPod.Status.PodIP || podRestartCount(oldPod) != podRestartCount(newPod) {
+				log.Debugf("pod %s is updated with IP %s", newPod.Name, newPod.Status.PodIP)
+				triggerSealCheck()
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			// a deletion missed while the watch was down comes as the last known state of the pod
+			if tombstone, isTombstone := obj.(cache.DeletedFinalStateUnknown); isTombstone {
+				obj = tombstone.Obj
+			}
+			pod, isPod := obj.(*v1.Pod)
+			if !isPod {
+				log.Errorf("unexpected object %T in the pod deletion", obj)
+				return
+			}
+			log.Debugf("pod %s is deleted", pod.Name)
+			untrackPod(string(pod.UID))
+			triggerSealCheck()
+		},
+	})
+	podLister = podInformer.Lister()
+	factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, podInformer.Informer().HasSynced) {
+		log.Fatal("error while syncing the pod informer cache")
+	}
+	log.Infof("Pod informer synced for the label selectors %s with resync period of %v", vaultLabelSelectors, resyncPeriod)
+}
+
+// triggerSealCheck signals the routine to check the seal status; the signals are coalesced
+// when a check is already pending
+func triggerSealCheck() {
+	select {
+	case podEventCh <- struct{}{}:
+	default:
+	}
+}
+
+// isPodReachable returns true when the pod is running and has got an IP assigned
+func isPodReachable(pod *v1.Pod) bool {
+	return pod.Status.Phase == v1.PodRunning && len(pod.Status.PodIP) > 0
+}
+
+// podRestartCount returns the sum of the restarts of all the containers in the pod, as a vault
+// container restarting in place comes back sealed on the same IP
+func podRestartCount(pod *v1.Pod) int32 {
+	var restarts int32
+	for _, containerStatus := range pod.Status.ContainerStatuses {
+		restarts += containerStatus.RestartCount
+	}
+	return restarts
+}
@@ -0,0 +1,228 @@
+package utility
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strconv"
+	"strings"
+	"vault-initializer/common"
+)
+
+// managedObjects holds the names of the vault objects per kind, keyed as in managedObjectKeys
+type managedObjects map[string][]string
+
+var (
+	pruneEnabled   bool
+	pruneProtected managedObjects
+
+	// managedObjectKeys are the keys of the kinds in the state secret and in pruneProtected
+	managedObjectKeys = map[string]string{
+		common.ObjectPolicy:       "policies",
+		common.ObjectSecretEngine: "secretEngines",
+		common.ObjectAuthMethod:   "authMethods",
+		common.ObjectAuthObject:   "authObjects",
+	}
+
+	// pruneOrder deletes the bindings before the policies they refer to, and the auth methods last
+	pruneOrder = []string{common.ObjectAuthObject, common.ObjectPolicy, common.ObjectSecretEngine, common.ObjectAuthMethod}
+
+	// builtinObjects come with vault and are never pruned
+	builtinObjects = managedObjects{
+		"policies":      {"root", "default"},
+		"secretEngines": {"sys", "cubbyhole", "identity"},
+		"authMethods":   {"token"},
+	}
+)
+
+// parsePruneConfig extracts the opt-in pruning and the objects protected from it
+func parsePruneConfig(configData map[string]string) {
+	pruneEnabled = false
+	if len(configData["pruneEnabled"]) > 0 {
+		pruneEnabled, err = strconv.ParseBool(strings.TrimSpace(configData["pruneEnabled"]))
+		if err != nil {
+			log.Warnf("error while parsing the prune input, defaulting to disabled")
+			pruneEnabled = false
+		}
+	}
+	pruneProtected = managedObjects{}
+	if len(configData["pruneProtected"]) > 0 {
+		if err := json.Unmarshal([]byte(configData["pruneProtected"]), &pruneProtected); err != nil {
+			log.Errorf("error while un-marshalling the protected objects, disabling the pruning: %v", err)
+			pruneEnabled = false
+		}
+	}
+}
+
+// objectPath provides the vault path of the given object
+func objectPath(kind, name string) string {
+	switch kind {
+	case common.ObjectPolicy:
+		return "sys/policy/" + name
+	case common.ObjectSecretEngine:
+		return "sys/mounts/" + name
+	case common.ObjectAuthMethod:
+		return "sys/auth/" + name
+	case common.ObjectAuthObject:
+		return "auth/" + name
+	}
+	return ""
+}
+
+// contains returns true when the name is listed under the given kind
+func (objects managedObjects) contains(kind, name string) bool {
+	for _, listed := range objects[managedObjectKeys[kind]] {
+		if listed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// add lists the name under the given kind, once
+func (objects managedObjects) add(kind, name string) {
+	if objects.contains(kind, name) {
+		return
+	}
+	key := managedObjectKeys[kind]
+	objects[key] = append(objects[key], name)
+	sort.Strings(objects[key])
+}
+
+// remove drops the name from the given kind
+func (objects managedObjects) remove(kind, name string) {
+	key := managedObjectKeys[kind]
+	for i, listed := range objects[key] {
+		if listed == name {
+			objects[key] = append(objects[key][:i], objects[key][i+1:]...)
+			return
+		}
+	}
+}
+
+// track records the outcome of the applied change; the objects created by the initializer are owned
+// by it, the objects which existed before are never owned and thus never pruned
+func (objects managedObjects) track(change VaultChange) bool {
+	if len(managedObjectKeys[change.Kind]) == 0 {
+		return false
+	}
+	switch change.Action {
+	case common.ChangeCreate:
+		if !objects.contains(change.Kind, change.Name) {
+			objects.add(change.Kind, change.Name)
+			return true
+		}
+	case common.ChangeDelete:
+		if objects.contains(change.Kind, change.Name) {
+			objects.remove(change.Kind, change.Name)
+			return true
+		}
+	}
+	return false
+}
+
+// desiredObjects provides the objects declared in the config map
+func desiredObjects() (managedObjects, error) {
+	desired := managedObjects{}
+	for key := range configMapObject.Data {
+		if strings.HasSuffix(key, ".hcl") {
+			desired.add(common.ObjectPolicy, strings.TrimSuffix(key, ".hcl"))
+		}
+	}
+	if len(configMapObject.Data["secretEngines"]) > 0 {
+		var secretEngineInterface map[string]map[string]interface{}
+		if err := json.Unmarshal([]byte(configMapObject.Data["secretEngines"]), &secretEngineInterface); err != nil {
+			return nil, fmt.Errorf("error while un-marshalling the secret engines, err: %v", err)
+		}
+		for engineName := range secretEngineInterface {
+			desired.add(common.ObjectSecretEngine, strings.TrimSpace(engineName))
+		}
+	}
+	specs, err := authMethodSpecs(configMapObject.Data)
+	if err != nil {
+		return nil, err
+	}
+	for path, spec := range specs {
+		desired.add(common.ObjectAuthMethod, path)
+		for objectName := range authObjects(spec) {
+			desired.add(common.ObjectAuthObject, path+"/"+objectName)
+		}
+	}
+	if initializerPolicyManaged() {
+		desired.add(common.ObjectPolicy, common.InitializerPolicyName)
+	}
+	if len(initializerAuthPath) > 0 {
+		desired.add(common.ObjectAuthObject, initializerRoleName())
+	}
+	breakGlass, err := breakGlassSpec(configMapObject.Data)
+	if err != nil {
+		return nil, err
+	}
+	if breakGlass != nil {
+		for _, userName := range breakGlassUserNames(breakGlass) {
+			desired.add(common.ObjectAuthObject, breakGlass.Path+"/users/"+userName)
+		}
+	}
+	return desired, nil
+}
+
+// planPrune plans the deletion of the owned objects which are no longer declared in the config map,
+// except the protected and the builtin ones
+func planPrune(baseURL string, owned managedObjects) ([]VaultChange, error) {
+	if !pruneEnabled {
+		return nil, nil
+	}
+	desired, err := desiredObjects()
+	if err != nil {
+		return nil, err
+	}
+	var changes []VaultChange
+	for _, kind := range pruneOrder {
+		for _, name := range owned[managedObjectKeys[kind]] {
+			if desired.contains(kind, name) || pruneProtected.contains(kind, name) || builtinObjects.contains(kind, name) {
+				continue
+			}
+			changes = append(changes, VaultChange{
+				Kind:    kind,
+				Name:    name,
+				Action:  common.ChangeDelete,
+				Current: objectPath(kind, name),
+				apply:   writeVaultFunc(baseURL+"/v1/"+objectPath(kind, name), "", common.HttpMethodDELETE),
+			})
+		}
+	}
+	return changes, nil
+}
+
+// readManagedObjects reads the objects owned by the initializer from the state entry of the key store
+func readManagedObjects() (managedObjects, error) {
+	owned := managedObjects{}
+	stateData, _, err := keyStore.Read(common.StateSecretName)
+	if errors.Is(err, errKeyNotFound) {
+		return owned, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error while reading the state %s: %w", common.StateSecretName, err)
+	}
+	if err := json.Unmarshal([]byte(stateData[common.ManagedObjectsDataKey]), &owned); err != nil {
+		return nil, fmt.Errorf("error while un-marshalling the managed objects in the state %s: %v", common.StateSecretName, err)
+	}
+	return owned, nil
+}
+
+// storeManagedObjects writes the objects owned by the initializer into the state entry of the key store,
+// keeping the other keys of the state
+func storeManagedObjects(owned managedObjects) error {
+	ownedJSON, _ := json.Marshal(owned)
+	stateData, _, err := keyStore.Read(common.StateSecretName)
+	if err != nil && !errors.Is(err, errKeyNotFound) {
+		return err
+	}
+	if stateData == nil {
+		stateData = make(map[string]string)
+	}
+	stateData[common.ManagedObjectsDataKey] = string(ownedJSON)
+	return keyStore.Write(common.StateSecretName, stateData)
+}
@@ -0,0 +1,540 @@
+package utility
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"vault-initializer/common"
+)
+
+var (
+	// lastAppliedConfigs holds the hash of the last written write-only fields of the config per path, as
+	// the fields like the bindpass are never returned by vault to compare against
+	lastAppliedConfigs      = make(map[string]string)
+	lastAppliedConfigsMutex sync.Mutex
+)
+
+// VaultChange is a single change needed to converge the vault to the desired state, along with the
+// current and the desired values of what differs
+type VaultChange struct {
+	Kind    string      `json:"kind"`
+	Name    string      `json:"name"`
+	Action  string      `json:"action"`
+	Current interface{} `json:"current,omitempty"`
+	Desired interface{} `json:"desired,omitempty"`
+	apply   func() error
+}
+
+// reconcileVaultConfiguration reads the current LDAP auth, policies, policy bindings and secret engines
+// from the vault and converges them to the desired state in the config map; only the differences are
+// written, so it is safe to be run on every reconcile cycle and after a restart. The objects created
+// are recorded in the state secret, the ones no longer declared are deleted when the pruning is enabled.
+// The initializer logs in or renews its token before, and stops using the root token once the vault is configured.
+func reconcileVaultConfiguration() (int, error) {
+	firstPodName, firstPodIP, err := getFirstResponsivePod()
+	if err != nil {
+		return 0, err
+	}
+	baseURL := podBaseURL(firstPodIP)
+	if err := refreshInitializerAuth(baseURL); err != nil {
+		return 0, err
+	}
+	if err := convergeInitializerPolicy(firstPodName, baseURL); err != nil {
+		return 0, err
+	}
+	changes, owned, err := planVaultConfiguration(baseURL)
+	if err != nil {
+		return 0, err
+	}
+	if len(changes) == 0 {
+		log.Debugf("Vault configuration on the pod %s is up to date", firstPodName)
+	} else if err := applyChanges(firstPodName, changes, owned); err != nil {
+		return len(changes), err
+	}
+	// the root token is needed only until the first configuration
+	return len(changes), handOverFromRootToken(baseURL)
+}
+
+// PlanVaultConfiguration provides the changes the reconcile would apply to the vault, without writing anything
+func PlanVaultConfiguration() ([]VaultChange, error) {
+	defer startTargets()()
+	_, firstPodIP, err := getFirstResponsivePod()
+	if err != nil {
+		return nil, err
+	}
+	// the plan neither logs in nor renews the token, it uses the one at hand
+	if _, err := authToken(); err != nil {
+		return nil, fmt.Errorf("%w: %v", errNoAuthToken, err)
+	}
+	changes, _, err := planVaultConfiguration(podBaseURL(firstPodIP))
+	return changes, err
+}
+
+// planVaultConfiguration compares the config map against the vault and provides the changes in the order
+// to be applied, along with the objects owned by the initializer
+func planVaultConfiguration(baseURL string) ([]VaultChange, managedObjects, error) {
+	owned, err := readManagedObjects()
+	if err != nil {
+		return nil, nil, err
+	}
+	var changes []VaultChange
+	for _, plan := range []func(string) ([]VaultChange, error){planPoliciesInPod, planAuthMethodsInPod, planInitializerLoginInPod, planBreakGlassInPod, planSecretEnginesInPod} {
+		planned, err := plan(baseURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		changes = append(changes, planned...)
+	}
+	pruned, err := planPrune(baseURL, owned)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(changes, pruned...), owned, nil
+}
+
+// applyChanges applies the changes in the planned order and records the owned objects in the state
+// secret, including when a change in the middle fails
+func applyChanges(podName string, changes []VaultChange, owned managedObjects) error {
+	ownedChanged := false
+	var applyErr error
+	for _, change := range changes {
+		log.Infof("Applying %s of %s %s on the pod %s", change.Action, change.Kind, change.Name, podName)
+		if err := change.apply(); err != nil {
+			applyErr = fmt.Errorf("error while applying %s of %s %s on the pod %s: %w", change.Action, change.Kind, change.Name, podName, err)
+			break
+		}
+		if owned.track(change) {
+			ownedChanged = true
+		}
+	}
+	if ownedChanged {
+		if err := storeManagedObjects(owned); err != nil {
+			log.Errorf("error while storing the managed objects in the state secret %s: %v", common.StateSecretName, err)
+		}
+	}
+	return applyErr
+}
+
+// convergeInitializerPolicy writes the policy of the initializer ahead of the other changes, as it covers only
+// the auth methods declared; the objects of a newly declared auth method cannot be read back before
+func convergeInitializerPolicy(podName, baseURL string) error {
+	if !initializerPolicyManaged() {
+		return nil
+	}
+	owned, err := readManagedObjects()
+	if err != nil {
+		return err
+	}
+	policyHCL, err := initializerPolicyHCL()
+	if err != nil {
+		return err
+	}
+	change, err := planPolicy(baseURL, common.InitializerPolicyName, policyHCL)
+	if err != nil || change == nil {
+		return err
+	}
+	return applyChanges(podName, []VaultChange{*change}, owned)
+}
+
+// planPoliciesInPod plans the writes of the *.hcl policies which are missing or differ from the vault, along
+// with the policy of the initializer itself
+func planPoliciesInPod(baseURL string) ([]VaultChange, error) {
+	var changes []VaultChange
+	for _, key := range sortedKeys(configMapObject.Data) {
+		if !strings.HasSuffix(key, ".hcl") {
+			continue
+		}
+		change, err := planPolicy(baseURL, strings.TrimSuffix(key, ".hcl"), configMapObject.Data[key])
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+	if initializerPolicyManaged() {
+		policyHCL, err := initializerPolicyHCL()
+		if err != nil {
+			return nil, err
+		}
+		change, err := planPolicy(baseURL, common.InitializerPolicyName, policyHCL)
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+	return changes, nil
+}
+
+// planPolicy plans the write of the policy when it is missing or its rules differ from the vault
+func planPolicy(baseURL, policyName, policyHCL string) (*VaultChange, error) {
+	current, err := readVault(baseURL, "sys/policy/"+policyName)
+	if err != nil {
+		return nil, err
+	}
+	action := common.ChangeCreate
+	var currentRules interface{}
+	if current != nil {
+		rules, _ := vaultData(current)["rules"].(string)
+		if strings.TrimSpace(rules) == strings.TrimSpace(policyHCL) {
+			return nil, nil
+		}
+		action = common.ChangeUpdate
+		currentRules = rules
+	}
+	payload, _ := json.Marshal(map[string]string{"policy": policyHCL})
+	return &VaultChange{
+		Kind:    common.ObjectPolicy,
+		Name:    policyName,
+		Action:  action,
+		Current: currentRules,
+		Desired: policyHCL,
+		apply:   writeVaultFunc(baseURL+"/v1/sys/policy/"+policyName, string(payload), common.HttpMethodPUT),
+	}, nil
+}
+
+// planAuthObject plans the write of a role, user, group or cert of an auth method, named by its path under auth/,
+// when it is missing or any of its declared fields differ from the vault
+func planAuthObject(baseURL, name string, desired map[string]interface{}) (*VaultChange, error) {
+	path := objectPath(common.ObjectAuthObject, name)
+	current, err := readVault(baseURL, path)
+	if err != nil {
+		return nil, err
+	}
+	action := common.ChangeCreate
+	var currentValues interface{}
+	if current != nil {
+		differing := differingFields(vaultData(current), desired)
+		if len(differing) == 0 {
+			return nil, nil
+		}
+		action = common.ChangeUpdate
+		currentValues = differing
+	}
+	payload, _ := json.Marshal(desired)
+	return &VaultChange{
+		Kind:    common.ObjectAuthObject,
+		Name:    name,
+		Action:  action,
+		Current: currentValues,
+		Desired: redactFields(desired),
+		apply:   writeVaultFunc(baseURL+"/v1/"+path, string(payload), common.HttpMethodPUT),
+	}, nil
+}
+
+// differingFields provides the current values of the declared fields which differ from the vault. The
+// token fields are read back with their token_ prefix by the newer vault versions, and the fields which
+// are not read back at all, as the credentials, cannot be compared and are skipped.
+func differingFields(current, desired map[string]interface{}) map[string]interface{} {
+	differing := make(map[string]interface{})
+	for key, desiredValue := range desired {
+		currentValue, found := current[key]
+		if !found {
+			currentValue, found = current["token_"+key]
+		}
+		if found && !sameValue(currentValue, desiredValue) {
+			differing[key] = currentValue
+		}
+	}
+	return differing
+}
+
+// sameValue compares a field read from the vault against the declared one; the lists regardless of the
+// order and of being comma separated, the durations as the seconds vault reports them in and the objects,
+// such as bound_claims, key by key; a field left out by the vault matches an empty declared one
+func sameValue(current, desired interface{}) bool {
+	if desiredObject, isObject := desired.(map[string]interface{}); isObject {
+		currentObject, _ := current.(map[string]interface{})
+		if len(currentObject) != len(desiredObject) {
+			return false
+		}
+		for key, desiredValue := range desiredObject {
+			if currentValue, found := currentObject[key]; !found || !sameValue(currentValue, desiredValue) {
+				return false
+			}
+		}
+		return true
+	}
+	if desiredList, isList := desired.([]interface{}); isList {
+		desiredStrings := make([]string, 0, len(desiredList))
+		for _, value := range desiredList {
+			desiredStrings = append(desiredStrings, fmt.Sprint(value))
+		}
+		return samePolicies(current, desiredStrings)
+	}
+	if currentList, isList := current.([]interface{}); isList {
+		desiredString, _ := desired.(string)
+		return samePolicies(currentList, strings.Split(desiredString, ","))
+	}
+	if current == nil {
+		desiredString, isString := desired.(string)
+		return isString && len(desiredString) == 0
+	}
+	if currentNumber, isNumber := current.(float64); isNumber {
+		if desiredString, isString := desired.(string); isString {
+			if duration, err := time.ParseDuration(desiredString); err == nil {
+				return currentNumber == duration.Seconds()
+			}
+		}
+	}
+	return fmt.Sprint(current) == fmt.Sprint(desired)
+}
+
+// planSecretEnginesInPod plans the enabling and the tuning of the secret engines
+func planSecretEnginesInPod(baseURL string) ([]VaultChange, error) {
+	if len(configMapObject.Data["secretEngines"]) == 0 {
+		return nil, nil
+	}
+	var secretEngineInterface map[string]map[string]interface{}
+	if err := json.Unmarshal([]byte(configMapObject.Data["secretEngines"]), &secretEngineInterface); err != nil {
+		return nil, fmt.Errorf("error while un-marshalling the secret engines, err: %v", err)
+	}
+	var changes []VaultChange
+	for _, engineName := range sortedKeys(secretEngineInterface) {
+		planned, err := planMount(baseURL, "sys/mounts", strings.TrimSpace(engineName), common.ObjectSecretEngine, secretEngineInterface[engineName])
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, planned...)
+	}
+	return changes, nil
+}
+
+// planMount plans the enabling of a secret engine or auth method at the given path when it is missing,
+// or the tuning of its description and config when they differ. A mount of a different type cannot be
+// converged without losing its data, so it is reported as an error.
+func planMount(baseURL, mountsPath, path, kind string, desired map[string]interface{}) ([]VaultChange, error) {
+	current, err := readVault(baseURL, mountsPath)
+	if err != nil {
+		return nil, err
+	}
+	mount, found := vaultData(current)[path+"/"].(map[string]interface{})
+	payload, _ := json.Marshal(desired)
+	if !found {
+		return []VaultChange{{
+			Kind:    kind,
+			Name:    path,
+			Action:  common.ChangeCreate,
+			Desired: desired,
+			apply:   writeVaultFunc(baseURL+"/v1/"+mountsPath+"/"+path, string(payload), common.HttpMethodPOST),
+		}}, nil
+	}
+	if desiredType, _ := desired["type"].(string); len(desiredType) > 0 && mount["type"] != desiredType {
+		return nil, fmt.Errorf("%s %s is of type %v in vault, but %s is desired; it has to be changed by hand", kind, path, mount["type"], desiredType)
+	}
+
+	tunePayload := make(map[string]interface{})
+	currentValues := make(map[string]interface{})
+	if description, found := desired["description"]; found && description != mount["description"] {
+		tunePayload["description"] = description
+		currentValues["description"] = mount["description"]
+	}
+	desiredConfig, _ := desired["config"].(map[string]interface{})
+	currentConfig, _ := mount["config"].(map[string]interface{})
+	// the declared keys are compared, as vault leaves some of the tune keys out of the mount until they are set
+	for key, value := range desiredConfig {
+		if currentValue := currentConfig[key]; !sameValue(currentValue, value) {
+			tunePayload[key] = value
+			currentValues[key] = currentValue
+		}
+	}
+	if len(tunePayload) == 0 {
+		return nil, nil
+	}
+	tuneJSON, _ := json.Marshal(tunePayload)
+	return []VaultChange{{
+		Kind:    kind,
+		Name:    path,
+		Action:  common.ChangeUpdate,
+		Current: currentValues,
+		Desired: tunePayload,
+		apply:   writeVaultFunc(baseURL+"/v1/"+mountsPath+"/"+path+"/tune", string(tuneJSON), common.HttpMethodPOST),
+	}}, nil
+}
+
+// planConfigWrite plans the write of the config when it is missing or any field vault reads back differs
+// from it. The fields vault never returns, such as the bindpass, are compared against the last written ones
+// by their hash, which is only known to this process; those found at its start are taken as in place.
+func planConfigWrite(baseURL, path string, config map[string]interface{}) (*VaultChange, error) {
+	current, err := readVault(baseURL, path)
+	if err != nil {
+		return nil, err
+	}
+	currentConfig, _ := current["data"].(map[string]interface{})
+	writeOnly := make(map[string]interface{})
+	for key, value := range config {
+		if _, found := currentConfig[key]; !found {
+			writeOnly[key] = value
+		}
+	}
+	writeOnlyJSON, _ := json.Marshal(writeOnly)
+	hash := sha256.Sum256(writeOnlyJSON)
+	writeOnlyHash := hex.EncodeToString(hash[:])
+	lastAppliedConfigsMutex.Lock()
+	lastHash, known := lastAppliedConfigs[path]
+	if !known && len(currentConfig) > 0 {
+		lastAppliedConfigs[path] = writeOnlyHash
+		lastHash = writeOnlyHash
+	}
+	lastAppliedConfigsMutex.Unlock()
+
+	action := common.ChangeWrite
+	var currentValues interface{}
+	if len(currentConfig) > 0 {
+		differing := differingFields(currentConfig, config)
+		if len(differing) == 0 && lastHash == writeOnlyHash {
+			return nil, nil
+		}
+		action = common.ChangeUpdate
+		if len(differing) > 0 {
+			currentValues = redactFields(differing)
+		}
+	}
+	payload, _ := json.Marshal(config)
+	write := writeVaultFunc(baseURL+"/v1/"+path, string(payload), common.HttpMethodPUT)
+	return &VaultChange{
+		Kind:    "config",
+		Name:    path,
+		Action:  action,
+		Current: currentValues,
+		Desired: redactFields(config),
+		apply: func() error {
+			if err := write(); err != nil {
+				return err
+			}
+			lastAppliedConfigsMutex.Lock()
+			lastAppliedConfigs[path] = writeOnlyHash
+			lastAppliedConfigsMutex.Unlock()
+			return nil
+		},
+	}, nil
+}
+
+// redactFields provides a copy of the payload with the credentials hidden
+func redactFields(payload map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(payload))
+	for key, value := range payload {
+		if strings.Contains(key, "pass") || strings.Contains(key, "secret") || strings.Contains(key, "key") || strings.Contains(key, "jwt") {
+			value = "<redacted>"
+		}
+		redacted[key] = value
+	}
+	return redacted
+}
+
+// readVault reads the given path with the auth token, returns nil when the path is not found. A path under an
+// auth method which is not enabled yet is denied by the policy of the initializer, until the method is enabled
+// along with the policy, so it is taken as not found as well.
+func readVault(baseURL, path string) (map[string]interface{}, error) {
+	response, err := FireRequest("", baseURL+"/v1/"+path, getAuthTokenHeaders(), common.HttpMethodGET)
+	var apiError *VaultAPIError
+	if errors.As(err, &apiError) && apiError.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if errors.As(err, &apiError) && apiError.StatusCode == http.StatusForbidden && strings.HasPrefix(path, "auth/") {
+		if enabled, enabledErr := authMethodEnabled(baseURL, strings.TrimPrefix(path, "auth/")); enabledErr == nil && !enabled {
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error while reading %s: %w", path, err)
+	}
+	var current map[string]interface{}
+	if err := parseJSONRespo(response, &current); err != nil {
+		return nil, fmt.Errorf("error while reading %s: %v", path, err)
+	}
+	return current, nil
+}
+
+// authMethodEnabled returns true when the path under auth/ belongs to an enabled auth method
+func authMethodEnabled(baseURL, path string) (bool, error) {
+	current, err := readVault(baseURL, "sys/auth")
+	if err != nil {
+		return false, err
+	}
+	for mountPath := range vaultData(current) {
+		if strings.HasSuffix(mountPath, "/") && strings.HasPrefix(path+"/", mountPath) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// writeVaultFunc provides the write of the payload to the given url with the auth token
+func writeVaultFunc(url, payload, method string) func() error {
+	return func() error {
+		_, err := FireRequest(payload, url, getAuthTokenHeaders(), method)
+		return err
+	}
+}
+
+// vaultData unwraps the data object of the vault response, the older vault
+// versions return some of the responses without it
+func vaultData(response map[string]interface{}) map[string]interface{} {
+	if data, found := response["data"].(map[string]interface{}); found {
+		return data
+	}
+	return response
+}
+
+// samePolicies compares the policies returned by vault, either a list or a comma separated string,
+// against the desired ones regardless of the order
+func samePolicies(current interface{}, desired []string) bool {
+	var currentPolicies []string
+	switch policies := current.(type) {
+	case string:
+		currentPolicies = strings.Split(policies, ",")
+	case []interface{}:
+		for _, policy := range policies {
+			currentPolicies = append(currentPolicies, fmt.Sprint(policy))
+		}
+	}
+	return strings.Join(normalizePolicies(currentPolicies), ",") == strings.Join(normalizePolicies(desired), ",")
+}
+
+// normalizePolicies trims, drops the empty entries and sorts the policies
+func normalizePolicies(policies []string) []string {
+	normalized := make([]string, 0, len(policies))
+	for _, policy := range policies {
+		if policy = strings.TrimSpace(policy); len(policy) > 0 {
+			normalized = append(normalized, policy)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// sortedKeys provides the keys of the map in sorted order, to plan the changes in a stable order
+func sortedKeys(data interface{}) []string {
+	var keys []string
+	switch typed := data.(type) {
+	case map[string]string:
+		for key := range typed {
+			keys = append(keys, key)
+		}
+	case map[string]map[string]interface{}:
+		for key := range typed {
+			keys = append(keys, key)
+		}
+	case map[string][]string:
+		for key := range typed {
+			keys = append(keys, key)
+		}
+	case map[string]common.AuthMethodSpec:
+		for key := range typed {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
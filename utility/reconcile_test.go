@@ -0,0 +1,224 @@
+package utility
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"vault-initializer/common"
+)
+
+const reconcileTestToken = "s.reconcile"
+
+func TestSameValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		current interface{}
+		desired interface{}
+		same    bool
+	}{
+		{name: "same string", current: "ldaps://ldap.example.com", desired: "ldaps://ldap.example.com", same: true},
+		{name: "other string", current: "ldaps://ldap.example.com", desired: "ldaps://ldap2.example.com"},
+		{name: "list in another order", current: []interface{}{"b", "a"}, desired: []interface{}{"a", "b"}, same: true},
+		{name: "list against a comma separated string", current: []interface{}{"app", "default"}, desired: "default, app", same: true},
+		{name: "comma separated string against a list", current: "default,app", desired: []interface{}{"app", "default"}, same: true},
+		{name: "list with another entry", current: []interface{}{"a"}, desired: []interface{}{"a", "b"}},
+		{name: "duration as seconds", current: float64(3600), desired: "1h", same: true},
+		{name: "other duration", current: float64(3600), desired: "768h"},
+		{name: "number", current: float64(3600), desired: float64(3600), same: true},
+		{name: "bool", current: true, desired: false},
+		{name: "same object", current: map[string]interface{}{"hd": []interface{}{"example.com"}}, desired: map[string]interface{}{"hd": "example.com"}, same: true},
+		{name: "object with another key", current: map[string]interface{}{"hd": "example.com"}, desired: map[string]interface{}{"hd": "example.com", "org": "acme"}},
+		{name: "missing field against an empty string", current: nil, desired: "", same: true},
+		{name: "missing field against an empty list", current: nil, desired: []interface{}{}, same: true},
+		{name: "missing field against an empty object", current: nil, desired: map[string]interface{}{}, same: true},
+		{name: "missing field against a value", current: nil, desired: "unauth"},
+		{name: "missing field against false", current: nil, desired: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if same := sameValue(test.current, test.desired); same != test.same {
+				t.Fatalf("expected the same value %v for %#v and %#v, got %v", test.same, test.current, test.desired, same)
+			}
+		})
+	}
+}
+
+func TestDifferingFields(t *testing.T) {
+	current := map[string]interface{}{
+		"url":            "ldaps://ldap.example.com",
+		"token_ttl":      float64(3600),
+		"token_policies": []interface{}{"default"},
+		"groupattr":      "cn",
+	}
+	tests := []struct {
+		name      string
+		desired   map[string]interface{}
+		differing map[string]interface{}
+	}{
+		{name: "same fields", desired: map[string]interface{}{"url": "ldaps://ldap.example.com", "groupattr": "cn"}, differing: map[string]interface{}{}},
+		{name: "token fields without their prefix", desired: map[string]interface{}{"ttl": "1h", "policies": "default"}, differing: map[string]interface{}{}},
+		{name: "other token field", desired: map[string]interface{}{"ttl": "2h"}, differing: map[string]interface{}{"ttl": float64(3600)}},
+		{name: "credentials never read back", desired: map[string]interface{}{"bindpass": "secret"}, differing: map[string]interface{}{}},
+		{
+			name:      "other fields",
+			desired:   map[string]interface{}{"url": "ldaps://ldap2.example.com", "groupattr": "cn", "token_policies": []interface{}{"default", "ldap"}},
+			differing: map[string]interface{}{"url": "ldaps://ldap.example.com", "token_policies": []interface{}{"default"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if differing := differingFields(current, test.desired); !reflect.DeepEqual(differing, test.differing) {
+				t.Fatalf("expected the differing fields %v, got %v", test.differing, differing)
+			}
+		})
+	}
+}
+
+func TestPlanMount(t *testing.T) {
+	vault := newFakeMounts(t, map[string]interface{}{
+		"secret/": map[string]interface{}{
+			"type":        "kv",
+			"description": "application secrets",
+			"config":      map[string]interface{}{"default_lease_ttl": float64(0), "max_lease_ttl": float64(3600), "force_no_cache": false},
+		},
+	})
+	defer vault.Close()
+	defer setReconcileTestVault(t)()
+
+	tests := []struct {
+		name    string
+		path    string
+		desired map[string]interface{}
+		action  string
+		current map[string]interface{}
+		request string
+		payload map[string]interface{}
+		err     string
+	}{
+		{
+			name:    "missing mount",
+			path:    "pki",
+			desired: map[string]interface{}{"type": "pki", "config": map[string]interface{}{"max_lease_ttl": "87600h"}},
+			action:  common.ChangeCreate,
+			request: "POST /v1/sys/mounts/pki",
+			payload: map[string]interface{}{"type": "pki", "config": map[string]interface{}{"max_lease_ttl": "87600h"}},
+		},
+		{
+			name:    "same mount",
+			path:    "secret",
+			desired: map[string]interface{}{"type": "kv", "description": "application secrets", "config": map[string]interface{}{"max_lease_ttl": "1h", "default_lease_ttl": "0s"}},
+		},
+		{
+			name:    "other duration and description",
+			path:    "secret",
+			desired: map[string]interface{}{"type": "kv", "description": "secrets", "config": map[string]interface{}{"max_lease_ttl": "768h"}},
+			action:  common.ChangeUpdate,
+			current: map[string]interface{}{"description": "application secrets", "max_lease_ttl": float64(3600)},
+			request: "POST /v1/sys/mounts/secret/tune",
+			payload: map[string]interface{}{"description": "secrets", "max_lease_ttl": "768h"},
+		},
+		{
+			name:    "tune key left out by the vault",
+			path:    "secret",
+			desired: map[string]interface{}{"config": map[string]interface{}{"listing_visibility": "unauth", "audit_non_hmac_request_keys": []interface{}{}}},
+			action:  common.ChangeUpdate,
+			current: map[string]interface{}{"listing_visibility": nil},
+			request: "POST /v1/sys/mounts/secret/tune",
+			payload: map[string]interface{}{"listing_visibility": "unauth"},
+		},
+		{
+			name:    "empty tune keys left out by the vault",
+			path:    "secret",
+			desired: map[string]interface{}{"config": map[string]interface{}{"listing_visibility": "", "passthrough_request_headers": []interface{}{}}},
+		},
+		{
+			name:    "mount of another type",
+			path:    "secret",
+			desired: map[string]interface{}{"type": "transit"},
+			err:     "it has to be changed by hand",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changes, err := planMount(vault.URL, "sys/mounts", test.path, common.ObjectSecretEngine, test.desired)
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected the error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(test.action) == 0 {
+				if len(changes) > 0 {
+					t.Fatalf("expected no change, got %+v", changes)
+				}
+				return
+			}
+			if len(changes) != 1 || changes[0].Action != test.action || changes[0].Name != test.path {
+				t.Fatalf("expected a single %s of %s, got %+v", test.action, test.path, changes)
+			}
+			if test.current != nil && !reflect.DeepEqual(changes[0].Current, test.current) {
+				t.Fatalf("expected the current values %v, got %v", test.current, changes[0].Current)
+			}
+			vault.requests = nil
+			if err := changes[0].apply(); err != nil {
+				t.Fatalf("unexpected error while applying: %v", err)
+			}
+			if len(vault.requests) != 1 || vault.requests[0].request != test.request || !reflect.DeepEqual(vault.requests[0].payload, test.payload) {
+				t.Fatalf("expected %s with %v, got %+v", test.request, test.payload, vault.requests)
+			}
+		})
+	}
+}
+
+// fakeMounts serves the mounts of a vault and records the writes
+type fakeMounts struct {
+	*httptest.Server
+	requests []fakeMountsRequest
+}
+
+type fakeMountsRequest struct {
+	request string
+	payload map[string]interface{}
+}
+
+// newFakeMounts serves the given mounts on sys/mounts and accepts every write
+func newFakeMounts(t *testing.T, mounts map[string]interface{}) *fakeMounts {
+	vault := &fakeMounts{}
+	vault.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != reconcileTestToken {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/v1/sys/mounts" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": mounts})
+			return
+		}
+		var payload map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("the payload of %s %s is not JSON: %v", r.Method, r.URL.Path, err)
+		}
+		vault.requests = append(vault.requests, fakeMountsRequest{request: r.Method + " " + r.URL.Path, payload: payload})
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return vault
+}
+
+// setReconcileTestVault points the vault requests to the plain http client with the test token, and provides
+// the restore of the earlier client
+func setReconcileTestVault(t *testing.T) func() {
+	t.Helper()
+	earlierClient := vaultHTTPClient
+	vaultHTTPClient = http.DefaultClient
+	restoreEnv := setTestEnv(t, map[string]string{common.VaultTokenEnv: reconcileTestToken})
+	return func() {
+		vaultHTTPClient = earlierClient
+		restoreEnv()
+	}
+}
@@ -0,0 +1,143 @@
+package utility
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"vault-initializer/common"
+
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// retryableError marks an error to be retried regardless of its type
+type retryableError struct {
+	err error
+}
+
+func (e retryableError) Error() string { return e.err.Error() }
+
+func (e retryableError) Unwrap() error { return e.err }
+
+// parseRetryConfig extracts the retry policy applied to all the vault and kubernetes calls
+func parseRetryConfig(configData map[string]string) {
+	common.RetryMaxAttempts = parsePositiveInt(configData, "retryMaxAttempts", common.DefaultRetryMaxAttempts)
+	common.RetryInitialBackoffMillis = parsePositiveInt(configData, "retryInitialBackoffInMillis", common.DefaultRetryInitialBackoff)
+	common.RetryMaxBackoffSeconds = parsePositiveInt(configData, "retryMaxBackoffInSeconds", common.DefaultRetryMaxBackoff)
+	common.RequestTimeoutSeconds = parsePositiveInt(configData, "requestTimeoutInSeconds", common.DefaultRequestTimeout)
+	common.RetryJitter = common.DefaultRetryJitter
+	if len(configData["retryJitter"]) > 0 {
+		jitter, err := strconv.ParseFloat(strings.TrimSpace(configData["retryJitter"]), 64)
+		if err != nil || jitter < 0 || jitter > 1 {
+			log.Warnf("retryJitter should be a fraction between 0 and 1, defaulting to %v", common.DefaultRetryJitter)
+		} else {
+			common.RetryJitter = jitter
+		}
+	}
+}
+
+// parsePositiveInt parses the given key as a positive number, falls back to the default value otherwise
+func parsePositiveInt(configData map[string]string, key string, defaultValue int) int {
+	if len(configData[key]) == 0 {
+		return defaultValue
+	}
+	value, err := strconv.Atoi(strings.TrimSpace(configData[key]))
+	if err != nil || value <= 0 {
+		log.Warnf("error while parsing the %s input, defaulting to %v", key, defaultValue)
+		return defaultValue
+	}
+	return value
+}
+
+// withRetry runs the call with the per-call timeout and retries the retryable errors with an exponential
+// backoff and jitter, up to the configured max attempts. The last error is returned as it is.
+func withRetry(operation string, call func(ctx context.Context) error) error {
+	backoff := time.Duration(common.RetryInitialBackoffMillis) * time.Millisecond
+	maxBackoff := time.Duration(common.RetryMaxBackoffSeconds) * time.Second
+	var err error
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(common.RequestTimeoutSeconds)*time.Second)
+		err = call(ctx)
+		cancel()
+		if err == nil || !isRetryable(err) || attempt >= common.RetryMaxAttempts {
+			return err
+		}
+		sleep := backoff + time.Duration(rand.Float64()*common.RetryJitter*float64(backoff))
+		log.Warnf("attempt %d of %d to %s failed, retrying in %v: %v", attempt, common.RetryMaxAttempts, operation, sleep, err)
+		time.Sleep(sleep)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// k8sCall runs the client-go call with the retry policy; as the client does not accept a context,
+// the call is abandoned when the per-call timeout is reached
+func k8sCall(operation string, call func() error) error {
+	return withRetry(operation, func(ctx context.Context) error {
+		result := make(chan error, 1)
+		go func() {
+			result <- call()
+		}()
+		select {
+		case err := <-result:
+			return err
+		case <-ctx.Done():
+			return retryableError{ctx.Err()}
+		}
+	})
+}
+
+// isRetryable classifies the error; the network failures, timeouts, throttling and the server side
+// errors of vault and kubernetes are retryable, the rejected requests and the certificate errors are not
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var markedErr retryableError
+	if errors.As(err, &markedErr) {
+		return true
+	}
+	var apiError *VaultAPIError
+	if errors.As(err, &apiError) {
+		return apiError.StatusCode == http.StatusTooManyRequests ||
+			(apiError.StatusCode >= http.StatusInternalServerError && apiError.StatusCode != http.StatusNotImplemented)
+	}
+	if apiErrors.IsServerTimeout(err) || apiErrors.IsTimeout(err) || apiErrors.IsTooManyRequests(err) ||
+		apiErrors.IsInternalError(err) || apiErrors.IsServiceUnavailable(err) || apiErrors.IsUnexpectedServerError(err) {
+		return true
+	}
+	if isCertificateError(err) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// isCertificateError returns true for the failed verification of the certificates and the TLS handshake, a
+// misconfiguration which is not fixed by retrying
+func isCertificateError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var systemRoots x509.SystemRootsError
+	var recordHeader tls.RecordHeaderError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid) ||
+		errors.As(err, &systemRoots) || errors.As(err, &recordHeader)
+}
@@ -0,0 +1,115 @@
+package utility
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"vault-initializer/common"
+
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const retryTestURL = "https://vault-0.vault-internal:8200/v1/sys/seal-status"
+
+func TestIsRetryable(t *testing.T) {
+	secrets := schema.GroupResource{Resource: "secrets"}
+	urlError := func(err error) error {
+		return &url.Error{Op: common.HttpMethodGET, URL: retryTestURL, Err: err}
+	}
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{name: "no error", err: nil},
+		{name: "marked retryable", err: retryableError{errors.New("lease is held")}, retryable: true},
+		{name: "vault throttling", err: &VaultAPIError{StatusCode: http.StatusTooManyRequests}, retryable: true},
+		{name: "vault internal error", err: &VaultAPIError{StatusCode: http.StatusInternalServerError}, retryable: true},
+		{name: "vault sealed", err: &VaultAPIError{StatusCode: http.StatusServiceUnavailable}, retryable: true},
+		{name: "vault not implemented", err: &VaultAPIError{StatusCode: http.StatusNotImplemented}},
+		{name: "vault bad request", err: &VaultAPIError{StatusCode: http.StatusBadRequest}},
+		{name: "vault permission denied", err: &VaultAPIError{StatusCode: http.StatusForbidden}},
+		{name: "wrapped vault error", err: fmt.Errorf("error while unsealing: %w", &VaultAPIError{StatusCode: http.StatusBadGateway}), retryable: true},
+		{name: "kubernetes server timeout", err: apiErrors.NewServerTimeout(secrets, "get", 1), retryable: true},
+		{name: "kubernetes throttling", err: apiErrors.NewTooManyRequests("too many requests", 1), retryable: true},
+		{name: "kubernetes internal error", err: apiErrors.NewInternalError(errors.New("etcd is down")), retryable: true},
+		{name: "kubernetes not found", err: apiErrors.NewNotFound(secrets, common.VaultKeysSecretName)},
+		{name: "kubernetes forbidden", err: apiErrors.NewForbidden(secrets, common.VaultKeysSecretName, errors.New("no rbac"))},
+		{name: "timeout", err: context.DeadlineExceeded, retryable: true},
+		{name: "connection refused", err: urlError(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}), retryable: true},
+		{name: "unknown authority", err: urlError(x509.UnknownAuthorityError{})},
+		{name: "wrong host name", err: urlError(x509.HostnameError{Certificate: &x509.Certificate{}, Host: "vault-0"})},
+		{name: "expired certificate", err: urlError(x509.CertificateInvalidError{Cert: &x509.Certificate{}, Reason: x509.Expired})},
+		{name: "plain error", err: errors.New("the init response cannot be parsed")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if retryable := isRetryable(test.err); retryable != test.retryable {
+				t.Fatalf("expected %v to be retryable %v, got %v", test.err, test.retryable, retryable)
+			}
+		})
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	parseRetryConfig(map[string]string{"retryMaxAttempts": "3", "retryInitialBackoffInMillis": "1", "retryJitter": "0"})
+	defer parseRetryConfig(map[string]string{})
+
+	serverError := &VaultAPIError{StatusCode: http.StatusInternalServerError}
+	tests := []struct {
+		name     string
+		errs     []error
+		attempts int
+		failed   bool
+	}{
+		{name: "first attempt succeeds", errs: []error{nil}, attempts: 1},
+		{name: "retried until it succeeds", errs: []error{serverError, serverError, nil}, attempts: 3},
+		{name: "retried up to the max attempts", errs: []error{serverError, serverError, serverError, nil}, attempts: 3, failed: true},
+		{name: "rejected request is not retried", errs: []error{&VaultAPIError{StatusCode: http.StatusBadRequest}, nil}, attempts: 1, failed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempts := 0
+			err := withRetry("test the retry", func(ctx context.Context) error {
+				attempts++
+				return test.errs[attempts-1]
+			})
+			if attempts != test.attempts {
+				t.Fatalf("expected %d attempts, got %d", test.attempts, attempts)
+			}
+			if (err != nil) != test.failed {
+				t.Fatalf("expected the failure %v, got %v", test.failed, err)
+			}
+		})
+	}
+}
+
+func TestWithRetryUntrustedCertificate(t *testing.T) {
+	parseRetryConfig(map[string]string{"retryMaxAttempts": "3", "retryInitialBackoffInMillis": "1", "retryJitter": "0"})
+	defer parseRetryConfig(map[string]string{})
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("the request should not pass the TLS handshake")
+	}))
+	defer server.Close()
+
+	attempts := 0
+	err := withRetry("test the untrusted certificate", func(ctx context.Context) error {
+		attempts++
+		_, err := fireRequestWithClient(ctx, http.DefaultClient, "", server.URL+"/v1/sys/seal-status", nil, common.HttpMethodGET)
+		return err
+	})
+	if err == nil || !isCertificateError(err) {
+		t.Fatalf("expected a certificate error, got %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("the certificate error should not be retried, got %d attempts", attempts)
+	}
+}
@@ -0,0 +1,92 @@
+package utility
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"vault-initializer/common"
+)
+
+// StartStatusServer serves the state of the initializer over http, or https when the certificate is
+// configured, along with the unseal share submission endpoint which is only served over https, on the configured listen address;
+// the handlers are registered on a dedicated mux so that the process can keep serving while the
+// routine is in progress or while waiting as a follower
+func StartStatusServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", statusHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/v1/unseal", unsealShareHandler)
+	go func() {
+		log.Infof("Serving the status on %s", common.StatusListenAddress)
+		var err error
+		if len(common.StatusTLSCertFile) > 0 && len(common.StatusTLSKeyFile) > 0 {
+			err = http.ListenAndServeTLS(common.StatusListenAddress, common.StatusTLSCertFile, common.StatusTLSKeyFile, mux)
+		} else {
+			if len(os.Getenv(common.UnsealAPITokenEnv)) > 0 {
+				log.Warnf("Share submission is disabled, the status is not served over https")
+			}
+			err = http.ListenAndServe(common.StatusListenAddress, mux)
+		}
+		if err != nil {
+			log.Fatalf("error while serving the status on %s: %v", common.StatusListenAddress, err)
+		}
+	}()
+}
+
+// statusHandler writes the leader identity, the tracked pods and their last observed seal status as JSON
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	leader, isLeader := getCurrentLeader()
+	status := common.InitializerStatus{
+		Identity: leaderIdentity,
+		Leader:   leader,
+		IsLeader: isLeader,
+		SealType: common.SealType,
+		Pods:     trackedPodList(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Errorf("error while writing the status response: %v", err)
+	}
+}
+
+// metricsHandler writes the leader and the pod gauges in the prometheus text exposition format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	leader, isLeader := getCurrentLeader()
+	pods := trackedPodList()
+	sealedPods, autoUnsealFailures := 0, 0
+	for _, podState := range pods {
+		if podState.Sealed {
+			sealedPods++
+		}
+		if podState.AutoUnsealFailure {
+			autoUnsealFailures++
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP vault_initializer_is_leader Whether this replica is holding the leader lease.")
+	fmt.Fprintln(w, "# TYPE vault_initializer_is_leader gauge")
+	fmt.Fprintf(w, "vault_initializer_is_leader{identity=%q} %d\n", leaderIdentity, boolToInt(isLeader))
+	fmt.Fprintln(w, "# HELP vault_initializer_leader_info Identity of the current leader.")
+	fmt.Fprintln(w, "# TYPE vault_initializer_leader_info gauge")
+	fmt.Fprintf(w, "vault_initializer_leader_info{leader=%q} 1\n", leader)
+	fmt.Fprintln(w, "# HELP vault_initializer_tracked_pods Number of vault pods tracked by the initializer.")
+	fmt.Fprintln(w, "# TYPE vault_initializer_tracked_pods gauge")
+	fmt.Fprintf(w, "vault_initializer_tracked_pods %d\n", len(pods))
+	fmt.Fprintln(w, "# HELP vault_initializer_sealed_pods Number of tracked vault pods last observed as sealed.")
+	fmt.Fprintln(w, "# TYPE vault_initializer_sealed_pods gauge")
+	fmt.Fprintf(w, "vault_initializer_sealed_pods %d\n", sealedPods)
+	fmt.Fprintln(w, "# HELP vault_initializer_auto_unseal_failures Number of tracked vault pods sealed beyond the grace period with an auto-unseal seal.")
+	fmt.Fprintln(w, "# TYPE vault_initializer_auto_unseal_failures gauge")
+	fmt.Fprintf(w, "vault_initializer_auto_unseal_failures %d\n", autoUnsealFailures)
+}
+
+// boolToInt converts the bool into the gauge value
+func boolToInt(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,198 @@
+package utility
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"vault-initializer/common"
+)
+
+// shareCollector holds the unseal shares submitted by the custodians in memory only, until the
+// threshold is reached; the shares are then fanned out to all the sealed pods and forgotten
+type shareCollector struct {
+	mutex       sync.Mutex
+	shares      []string
+	firstSubmit time.Time
+}
+
+var (
+	submittedShares shareCollector
+)
+
+// unsealShareHandler accepts a single unseal share from a custodian as {"key": "<share>"},
+// authenticated with the bearer token given in UNSEAL_API_TOKEN; the shares are only accepted over https
+func unsealShareHandler(w http.ResponseWriter, r *http.Request) {
+	apiToken := os.Getenv(common.UnsealAPITokenEnv)
+	if len(apiToken) == 0 {
+		http.Error(w, "share submission is disabled, "+common.UnsealAPITokenEnv+" is not set", http.StatusNotFound)
+		return
+	}
+	if r.TLS == nil {
+		http.Error(w, "share submission is disabled, statusTLSCertFile and statusTLSKeyFile are needed to serve it over https", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	givenToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(givenToken), []byte(apiToken)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if leader, isLeader := getCurrentLeader(); !isLeader {
+		http.Error(w, fmt.Sprintf("not the leader, submit the share to %s", leader), http.StatusServiceUnavailable)
+		return
+	}
+
+	var shareRequest struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&shareRequest); err != nil || len(strings.TrimSpace(shareRequest.Key)) == 0 {
+		http.Error(w, "request body should be {\"key\": \"<unseal share>\"}", http.StatusBadRequest)
+		return
+	}
+
+	progress := submittedShares.submit(strings.TrimSpace(shareRequest.Key))
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(progress); err != nil {
+		log.Errorf("error while writing the unseal progress response: %v", err)
+	}
+}
+
+// submit holds the share and fans out the shares to the sealed pods once the threshold is reached
+func (collector *shareCollector) submit(share string) common.UnsealProgress {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	threshold := unsealThreshold()
+
+	if len(collector.shares) > 0 && time.Since(collector.firstSubmit) > common.UnsealShareTTL*time.Minute {
+		log.Warnf("Discarding %d unseal shares held for more than %d minutes", len(collector.shares), common.UnsealShareTTL)
+		collector.reset()
+	}
+	for _, heldShare := range collector.shares {
+		if subtle.ConstantTimeCompare([]byte(heldShare), []byte(share)) == 1 {
+			return collector.progress(threshold, "share was already submitted")
+		}
+	}
+	if len(collector.shares) == 0 {
+		collector.firstSubmit = time.Now()
+	}
+	collector.shares = append(collector.shares, share)
+	log.Infof("Unseal share %d of %d is submitted", len(collector.shares), threshold)
+
+	if len(collector.shares) < threshold {
+		return collector.progress(threshold, "waiting for more shares")
+	}
+
+	progress := common.UnsealProgress{Submitted: len(collector.shares), Threshold: threshold, Complete: true}
+	for _, podState := range trackedPodList() {
+		if !isIndividualPodSealed(podState.Name, podState.IP) || !podOwnsIP(podState) {
+			continue
+		}
+		unsealResponse, err := unsealPodWithShares(podState, collector.shares)
+		if err != nil {
+			log.Errorf("error while unsealing the pod %s with the submitted shares: %v", podState.Name, err)
+			progress.FailedPods = append(progress.FailedPods, podState.Name)
+			continue
+		}
+		recordSealStatus(podState.UID, unsealResponse.Sealed)
+		if unsealResponse.Sealed {
+			progress.FailedPods = append(progress.FailedPods, podState.Name)
+		} else {
+			progress.UnsealedPods = append(progress.UnsealedPods, podState.Name)
+		}
+	}
+	collector.reset()
+	progress.Message = fmt.Sprintf("unsealed %d pods, %d pods failed", len(progress.UnsealedPods), len(progress.FailedPods))
+	log.Info(progress.Message)
+	return progress
+}
+
+// progress provides the submission progress without disclosing the shares
+func (collector *shareCollector) progress(threshold int, message string) common.UnsealProgress {
+	return common.UnsealProgress{Submitted: len(collector.shares), Threshold: threshold, Message: message}
+}
+
+// reset forgets the held shares
+func (collector *shareCollector) reset() {
+	for i := range collector.shares {
+		collector.shares[i] = ""
+	}
+	collector.shares = nil
+}
+
+// unsealPodWithShares submits the shares to the given pod. The nonce of the unseal attempt is tracked,
+// when the attempt was started or reset by someone else in the meantime, it is reset and started over.
+func unsealPodWithShares(podState common.PodState, shares []string) (common.VaultUnsealResp, error) {
+	podUnsealURL := podBaseURL(podState.IP) + "/v1/sys/unseal"
+	var unsealResponse common.VaultUnsealResp
+	for attempt := 0; attempt < 2; attempt++ {
+		sealStatus, err := getSealStatus(podState.IP)
+		if err != nil {
+			return unsealResponse, err
+		}
+		if sealStatus.Progress > 0 {
+			log.Warnf("Resetting the unseal attempt %s on the pod %s started by someone else", sealStatus.Nonce, podState.Name)
+			if _, err := FireRequest(`{"reset": true}`, podUnsealURL, nil, common.HttpMethodPUT); err != nil {
+				return unsealResponse, err
+			}
+		}
+
+		nonce := ""
+		nonceChanged := false
+		for _, share := range shares {
+			payload, _ := json.Marshal(map[string]string{"key": share})
+			responseBody, err := FireRequest(string(payload), podUnsealURL, nil, common.HttpMethodPUT)
+			if err != nil {
+				return unsealResponse, err
+			}
+			unsealResponse = common.VaultUnsealResp{}
+			if err := parseJSONRespo(responseBody, &unsealResponse); err != nil {
+				return unsealResponse, err
+			}
+			if !unsealResponse.Sealed {
+				log.Infof("Unsealing for the pod %s is done with the submitted shares.", podState.Name)
+				return unsealResponse, nil
+			}
+			if len(nonce) > 0 && unsealResponse.Nonce != nonce {
+				nonceChanged = true
+				break
+			}
+			nonce = unsealResponse.Nonce
+			log.Debugf("Unseal progress on the pod %s is %d of %d with nonce %s", podState.Name, unsealResponse.Progress, unsealResponse.T, nonce)
+		}
+		if !nonceChanged {
+			return unsealResponse, nil
+		}
+		log.Warnf("Unseal attempt on the pod %s was interrupted by someone else, starting over", podState.Name)
+	}
+	return unsealResponse, fmt.Errorf("unseal attempt on the pod %s kept getting interrupted", podState.Name)
+}
+
+// getSealStatus provides the parsed seal status of the vault running on the given pod IP
+func getSealStatus(podIP string) (common.VaultUnsealResp, error) {
+	var sealStatus common.VaultUnsealResp
+	sealStatusResponse, err := FireRequest("", podBaseURL(podIP)+"/v1/sys/seal-status", nil, common.HttpMethodGET)
+	if err != nil {
+		return sealStatus, err
+	}
+	err = parseJSONRespo(sealStatusResponse, &sealStatus)
+	return sealStatus, err
+}
+
+// unsealThreshold provides the threshold reported by the vault pods, or the configured one
+func unsealThreshold() int {
+	for _, podState := range trackedPodList() {
+		if sealStatus, err := getSealStatus(podState.IP); err == nil && sealStatus.T > 0 {
+			return sealStatus.T
+		}
+	}
+	return common.SecThreshold
+}
@@ -0,0 +1,110 @@
+package utility
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"strings"
+	"time"
+	"vault-initializer/common"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// TargetProvider discovers the vault instances the initializer works on
+type TargetProvider interface {
+	// Start starts watching the targets, their changes are signalled through triggerSealCheck
+	Start(stopCh <-chan struct{})
+	// Targets provides the running targets which have got an address
+	Targets() ([]common.PodState, error)
+	// OwnsAddress confirms the target is still running on its address, to never send the unseal
+	// keys to an unrelated instance that took over the address in the meantime
+	OwnsAddress(target common.PodState) bool
+}
+
+var (
+	targets TargetProvider
+)
+
+// UseStaticTargets works on the vaults at the given addresses instead of the pods, for the vaults running
+// on VMs or in docker-compose; as there are no events for them, they are checked every resync period
+func UseStaticTargets(addresses []string) {
+	provider := &staticTargetProvider{}
+	for _, address := range addresses {
+		address = strings.TrimSuffix(strings.TrimSpace(address), "/")
+		parsedURL, err := url.Parse(address)
+		if err != nil || len(parsedURL.Scheme) == 0 || len(parsedURL.Host) == 0 {
+			log.Fatalf("vault address %s should be a full address, e.g. https://vault-1:8200", address)
+		}
+		provider.targets = append(provider.targets, common.PodState{UID: address, Name: parsedURL.Host, IP: address})
+	}
+	if len(provider.targets) == 0 {
+		log.Fatal("no vault address is given")
+	}
+	targets = provider
+	log.Infof("Working on the vaults at %s", strings.Join(addresses, ", "))
+}
+
+// kubernetesTargetProvider discovers the vault pods matching the label selectors through the pod informer
+type kubernetesTargetProvider struct{}
+
+func (kubernetesTargetProvider) Start(stopCh <-chan struct{}) {
+	startPodInformer(stopCh)
+}
+
+func (kubernetesTargetProvider) Targets() ([]common.PodState, error) {
+	pods, err := podLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var running []common.PodState
+	for _, pod := range pods {
+		if pod.Status.Phase != v1.PodRunning {
+			continue
+		}
+		if len(pod.Status.PodIP) == 0 {
+			log.Warnf("No IP address found for %s", pod.Name)
+			continue
+		}
+		running = append(running, common.PodState{UID: string(pod.UID), Name: pod.Name, IP: pod.Status.PodIP})
+	}
+	return running, nil
+}
+
+func (kubernetesTargetProvider) OwnsAddress(target common.PodState) bool {
+	pod, err := podLister.Pods(namespace).Get(target.Name)
+	if err != nil {
+		return false
+	}
+	return string(pod.UID) == target.UID && pod.Status.PodIP == target.IP && isPodReachable(pod)
+}
+
+// staticTargetProvider holds the vaults given by their addresses, the address is the identity of the target
+type staticTargetProvider struct {
+	targets []common.PodState
+}
+
+func (provider *staticTargetProvider) Start(stopCh <-chan struct{}) {
+	resyncPeriod := time.Duration(common.PodResyncPeriodSeconds) * time.Second
+	go func() {
+		ticker := time.NewTicker(resyncPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				triggerSealCheck()
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	log.Infof("Checking the vaults every %v", resyncPeriod)
+}
+
+func (provider *staticTargetProvider) Targets() ([]common.PodState, error) {
+	return provider.targets, nil
+}
+
+func (provider *staticTargetProvider) OwnsAddress(target common.PodState) bool {
+	return true
+}
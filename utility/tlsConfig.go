@@ -0,0 +1,153 @@
+package utility
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"vault-initializer/common"
+
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	vaultHTTPClient *http.Client
+)
+
+// parseVaultConnectionConfig extracts the scheme, port and TLS settings used to reach the vault pods
+// from the config map and builds the shared http client for all the vault calls
+func parseVaultConnectionConfig(configData map[string]string) {
+	common.VaultScheme = common.DefaultVaultScheme
+	if len(configData["vaultScheme"]) > 0 {
+		scheme := strings.ToLower(strings.TrimSpace(configData["vaultScheme"]))
+		if scheme != "http" && scheme != "https" {
+			log.Fatalf("vaultScheme %s is not supported, it should be either http or https", scheme)
+		}
+		common.VaultScheme = scheme
+	}
+
+	common.VaultPort = common.DefaultVaultPort
+	if len(configData["vaultPort"]) > 0 {
+		common.VaultPort, err = strconv.Atoi(strings.TrimSpace(configData["vaultPort"]))
+		if err != nil {
+			log.Warnf("error while parsing the vault port input, defaulting to %d", common.DefaultVaultPort)
+			common.VaultPort = common.DefaultVaultPort
+		}
+	}
+
+	vaultHTTPClient, err = newVaultHTTPClient(configData)
+	if err != nil {
+		log.Fatalf("error while building the TLS configuration for vault: %v", err)
+	}
+	log.Infof("Vault pods will be accessed via %s on port %d", common.VaultScheme, common.VaultPort)
+}
+
+// newVaultHTTPClient builds the http client shared by FireRequest and the HEAD probes.
+// The CA bundle can come either from a secret (key ca.crt) or a mounted file, the client
+// certificate either from a kubernetes.io/tls secret or from the mounted cert and key files.
+// As the pod IPs are not part of the certificate SANs, the server name can be overridden.
+func newVaultHTTPClient(configData map[string]string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if common.VaultScheme == "https" {
+		tlsConfig := &tls.Config{
+			ServerName: strings.TrimSpace(configData["vaultTLSServerName"]),
+		}
+
+		caPEM, err := readTLSMaterial(configData["vaultCACertSecret"], common.CACertSecretKey, configData["vaultCACertFile"])
+		if err != nil {
+			return nil, fmt.Errorf("error while reading the CA bundle: %v", err)
+		}
+		if caPEM != nil {
+			certPool := x509.NewCertPool()
+			if !certPool.AppendCertsFromPEM(caPEM) {
+				return nil, fmt.Errorf("no valid certificates found in the CA bundle")
+			}
+			tlsConfig.RootCAs = certPool
+		}
+
+		certPEM, err := readTLSMaterial(configData["vaultClientCertSecret"], v1.TLSCertKey, configData["vaultClientCertFile"])
+		if err != nil {
+			return nil, fmt.Errorf("error while reading the client certificate: %v", err)
+		}
+		keyPEM, err := readTLSMaterial(configData["vaultClientCertSecret"], v1.TLSPrivateKeyKey, configData["vaultClientKeyFile"])
+		if err != nil {
+			return nil, fmt.Errorf("error while reading the client key: %v", err)
+		}
+		if certPEM != nil || keyPEM != nil {
+			if certPEM == nil || keyPEM == nil {
+				return nil, fmt.Errorf("both the client certificate and key are needed for the client authentication")
+			}
+			clientCert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				return nil, fmt.Errorf("error while loading the client key pair: %v", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{clientCert}
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// readTLSMaterial reads the given key from the secret if the secret name is provided,
+// else falls back to the mounted file; returns nil when neither is configured
+func readTLSMaterial(secretName, secretKey, filePath string) ([]byte, error) {
+	secretName = strings.TrimSpace(secretName)
+	filePath = strings.TrimSpace(filePath)
+	if len(secretName) > 0 {
+		if k8s == nil {
+			return nil, fmt.Errorf("secret %s cannot be read without kubernetes, use the file instead", secretName)
+		}
+		var secret *v1.Secret
+		err := k8sCall("get the secret "+secretName, func() error {
+			var err error
+			secret, err = k8s.Clientset.CoreV1().Secrets(namespace).Get(secretName, metaV1.GetOptions{})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		data, ok := secret.Data[secretKey]
+		if !ok {
+			return nil, fmt.Errorf("key %s not found in the secret %s", secretKey, secretName)
+		}
+		return data, nil
+	}
+	if len(filePath) > 0 {
+		return ioutil.ReadFile(filePath)
+	}
+	return nil, nil
+}
+
+// podBaseURL provides the base url of the vault service running on the given pod IP; the static
+// targets are given with their full address, which is used as it is
+func podBaseURL(podIP string) string {
+	if strings.Contains(podIP, "://") {
+		return strings.TrimSpace(podIP)
+	}
+	return common.VaultScheme + "://" + net.JoinHostPort(strings.TrimSpace(podIP), strconv.Itoa(common.VaultPort))
+}
+
+// probePod fires a HEAD request to the vault service running on the given pod IP.
+// The request is intentionally kept for the service wait time, as HEAD request should not take more time than that.
+func probePod(podIP string) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(common.WaitTimeSeconds)*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, podBaseURL(podIP), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := vaultHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return res, nil
+}
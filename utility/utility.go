@@ -1,13 +1,19 @@
 package utility
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	discovery "github.com/gkarthiks/k8s-discovery"
 	log "github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"net/http"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -15,20 +21,42 @@ import (
 )
 
 var (
-	k8s                                            *discovery.K8s
-	enableLDAPJsonStr, ldapConfigString, namespace string
-	vaultLabelSelectors                            string
-	parsedKeys                                     common.VaultInitResp
-	unsealResponse                                 common.VaultUnsealResp
-	configMapObject                                *v1.ConfigMap
-	err                                            error
-	podNameToIPMap                                 map[string]string
+	k8s                 *discovery.K8s
+	k8sConfig           *rest.Config
+	inClusterConfig     *rest.Config
+	namespace           string
+	vaultLabelSelectors string
+	parsedKeys          common.VaultInitResp
+	unsealResponse      common.VaultUnsealResp
+	configMapObject     *v1.ConfigMap
+	initConfigMapName   string
+	err                 error
 )
 
-func init() {
-	podNameToIPMap = make(map[string]string)
-	k8s, _ = discovery.NewK8s()
+// ConnectK8s connects to the kubernetes cluster the initializer is running in, or to the cluster of the
+// kubeconfig (KUBECONFIG or ~/.kube/config) outside of it; the init keys and the state are kept in the
+// secrets unless another key store is chosen
+func ConnectK8s() {
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{})
+	k8sConfig, err = clientConfig.ClientConfig()
+	if err != nil {
+		log.Fatalf("error while loading the kubernetes configuration: %v", err)
+	}
+	// the identity of the initializer itself, never the one of a personal kubeconfig, is given to the vault
+	inClusterConfig, _ = rest.InClusterConfig()
+	clientset, err := kubernetes.NewForConfig(k8sConfig)
+	if err != nil {
+		log.Fatalf("error while connecting to kubernetes: %v", err)
+	}
+	k8s = &discovery.K8s{Clientset: clientset}
 	namespace, _ = k8s.GetNamespace()
+	if len(namespace) == 0 {
+		namespace, _, _ = clientConfig.Namespace()
+	}
+	if keyStore == nil {
+		keyStore = secretKeyStore{}
+	}
 	version, _ := k8s.GetVersion()
 	log.Infof("Specified Namespace: %s ", namespace)
 	log.Infof("Version of running Kubernetes: %s ", version)
@@ -36,123 +64,198 @@ func init() {
 
 // Parses the config map initially and extracts the values for initialization
 func ParseInitConfigData(vaultInitConfigMap string) {
-	configMapObject, err = k8s.Clientset.CoreV1().ConfigMaps(namespace).Get(vaultInitConfigMap, metaV1.GetOptions{})
+	initConfigMapName = vaultInitConfigMap
+	var initConfigMap *v1.ConfigMap
+	err = k8sCall("get the init config map", func() error {
+		var err error
+		initConfigMap, err = k8s.Clientset.CoreV1().ConfigMaps(namespace).Get(vaultInitConfigMap, metaV1.GetOptions{})
+		return err
+	})
 	if err != nil {
 		log.Fatalf("error while accessing the initialization configuration settings from configmap %s in %s namespace", vaultInitConfigMap, namespace)
-	} else {
-		log.Debugf("Obtained ConfigMap data %v ", configMapObject.Data)
-		// Vault pod labels
+	}
+	parseInitConfig(initConfigMap)
+}
+
+// parseInitConfig extracts the values for initialization from the config map, or from the
+// config map converted from the VaultInitialization resource
+func parseInitConfig(initConfigMap *v1.ConfigMap) {
+	if err := ValidateConfigData(initConfigMap.Data); err != nil {
+		log.Fatalf("invalid configuration in %s: %v", initConfigMap.Name, err)
+	}
+	configMapObject = initConfigMap
+	log.Debugf("Obtained ConfigMap data %v ", configMapObject.Data)
+	// Vault targets; the vaults at the given addresses, else the vault pods of the labels
+	if targets == nil && len(strings.TrimSpace(configMapObject.Data["vaultAddresses"])) > 0 {
+		UseStaticTargets(strings.Split(configMapObject.Data["vaultAddresses"], ","))
+	}
+	if targets == nil {
+		if k8s == nil {
+			log.Fatal("Vault pods cannot be discovered without kubernetes, give the vault addresses instead")
+		}
 		if len(configMapObject.Data["vaultLabelSelector"]) > 0 {
 			vaultLabelSelectors = configMapObject.Data["vaultLabelSelector"]
 		} else {
 			errMessage := `vaultLabelSelector: 'app.kubernetes.io/name=vault,component=server'`
 			log.Panicf("Vault pod label selectors are not set, cannot continue. Please add an object as %s", errMessage)
 		}
+		targets = kubernetesTargetProvider{}
+	}
 
-		//	Secret Shares
-		if len(configMapObject.Data["secretShares"]) > 0 {
-			common.SecShares, err = strconv.Atoi(strings.TrimSpace(configMapObject.Data["secretShares"]))
-			if err != nil {
-				log.Warnf("error while parsing the secret shares input, defaulting to %v", common.DefaultSecretShares)
-				common.SecShares = common.DefaultSecretShares
-			}
-		} else {
-			log.Warnf("Secret Shares is not specified, defaulting to %d", common.DefaultSecretShares)
+	//	Secret Shares
+	if len(configMapObject.Data["secretShares"]) > 0 {
+		common.SecShares, err = strconv.Atoi(strings.TrimSpace(configMapObject.Data["secretShares"]))
+		if err != nil {
+			log.Warnf("error while parsing the secret shares input, defaulting to %v", common.DefaultSecretShares)
 			common.SecShares = common.DefaultSecretShares
 		}
-		//	Secret Threshold
-		if len(configMapObject.Data["secretThreshold"]) > 0 {
-			common.SecThreshold, err = strconv.Atoi(strings.TrimSpace(configMapObject.Data["secretThreshold"]))
-			if err != nil {
-				log.Warnf("error while parsing the secret threshold input, defaulting to %v", common.DefaultSecretThreshold)
-				common.SecThreshold = common.DefaultSecretThreshold
-			}
-		} else {
-			log.Warnf("Secret Threshold is not specified, defaulting to %d", common.DefaultSecretThreshold)
+	} else {
+		log.Warnf("Secret Shares is not specified, defaulting to %d", common.DefaultSecretShares)
+		common.SecShares = common.DefaultSecretShares
+	}
+	//	Secret Threshold
+	if len(configMapObject.Data["secretThreshold"]) > 0 {
+		common.SecThreshold, err = strconv.Atoi(strings.TrimSpace(configMapObject.Data["secretThreshold"]))
+		if err != nil {
+			log.Warnf("error while parsing the secret threshold input, defaulting to %v", common.DefaultSecretThreshold)
 			common.SecThreshold = common.DefaultSecretThreshold
 		}
-		//	Service Wait time for periodic checks of vault availability
-		if len(configMapObject.Data["serviceWaitTimeInSeconds"]) > 0 {
-			common.WaitTimeSeconds, err = strconv.Atoi(strings.TrimSpace(configMapObject.Data["serviceWaitTimeInSeconds"]))
-			if err != nil {
-				log.Warnf("error while parsing the wait time input, defaulting to %v", common.WaitTime)
-				common.WaitTimeSeconds = common.WaitTime
-			}
-		} else {
-			log.Warnf("Wait time is not specified, defaulting to %d", common.WaitTime)
-			common.WaitTimeSeconds = common.WaitTime
+	} else {
+		log.Warnf("Secret Threshold is not specified, defaulting to %d", common.DefaultSecretThreshold)
+		common.SecThreshold = common.DefaultSecretThreshold
+	}
+	//	Resync period of the pod informer, used as a fallback for the missed pod events
+	if len(configMapObject.Data["podResyncPeriodInSeconds"]) > 0 {
+		common.PodResyncPeriodSeconds, err = strconv.Atoi(strings.TrimSpace(configMapObject.Data["podResyncPeriodInSeconds"]))
+		if err != nil {
+			log.Warnf("error while parsing the pod resync period input, defaulting to %v", common.DefaultPodResyncPeriod)
+			common.PodResyncPeriodSeconds = common.DefaultPodResyncPeriod
 		}
-
-		//	LDAP Configurations
-		if len(configMapObject.Data["enableLDAP"]) > 0 {
-			enableLDAPJsonStr = configMapObject.Data["enableLDAP"]
-		} else {
-			log.Warnf("LDAP enable JSON payload is not provided, defaulting with basic enable payload")
-			enableLDAPJsonStr = fmt.Sprintf(`{ "type": "ldap", "description": "Login with LDAP" }`)
+	} else {
+		common.PodResyncPeriodSeconds = common.DefaultPodResyncPeriod
+	}
+	//	Listen address of the status endpoint
+	if len(configMapObject.Data["statusListenAddress"]) > 0 {
+		common.StatusListenAddress = strings.TrimSpace(configMapObject.Data["statusListenAddress"])
+	} else {
+		common.StatusListenAddress = common.DefaultStatusAddress
+	}
+	common.StatusTLSCertFile = strings.TrimSpace(configMapObject.Data["statusTLSCertFile"])
+	common.StatusTLSKeyFile = strings.TrimSpace(configMapObject.Data["statusTLSKeyFile"])
+	//	Leader election between the replicas
+	if len(configMapObject.Data["leaderElectionEnabled"]) > 0 {
+		common.LeaderElectionEnabled, err = strconv.ParseBool(strings.TrimSpace(configMapObject.Data["leaderElectionEnabled"]))
+		if err != nil {
+			log.Warnf("error while parsing the leader election input, defaulting to disabled")
+			common.LeaderElectionEnabled = false
 		}
-
-		if len(configMapObject.Data["ldapConfig"]) > 0 {
-			ldapConfigString = configMapObject.Data["ldapConfig"]
-		} else {
-			log.Fatal("LDAP Configuration not found.")
+	}
+	if len(configMapObject.Data["leaderElectionLeaseName"]) > 0 {
+		common.LeaderElectionLeaseName = strings.TrimSpace(configMapObject.Data["leaderElectionLeaseName"])
+	} else {
+		common.LeaderElectionLeaseName = common.DefaultLeaseName
+	}
+	//	Recovery shares and threshold, used when the vault is using an auto-unseal seal
+	common.RecoveryShares = common.SecShares
+	if len(configMapObject.Data["recoveryShares"]) > 0 {
+		common.RecoveryShares, err = strconv.Atoi(strings.TrimSpace(configMapObject.Data["recoveryShares"]))
+		if err != nil {
+			log.Warnf("error while parsing the recovery shares input, defaulting to %v", common.SecShares)
+			common.RecoveryShares = common.SecShares
 		}
-
 	}
+	common.RecoveryThreshold = common.SecThreshold
+	if len(configMapObject.Data["recoveryThreshold"]) > 0 {
+		common.RecoveryThreshold, err = strconv.Atoi(strings.TrimSpace(configMapObject.Data["recoveryThreshold"]))
+		if err != nil {
+			log.Warnf("error while parsing the recovery threshold input, defaulting to %v", common.SecThreshold)
+			common.RecoveryThreshold = common.SecThreshold
+		}
+	}
+	common.AutoUnsealGracePeriodSeconds = common.DefaultAutoUnsealGracePeriod
+	if len(configMapObject.Data["autoUnsealGracePeriodInSeconds"]) > 0 {
+		common.AutoUnsealGracePeriodSeconds, err = strconv.Atoi(strings.TrimSpace(configMapObject.Data["autoUnsealGracePeriodInSeconds"]))
+		if err != nil {
+			log.Warnf("error while parsing the auto-unseal grace period input, defaulting to %v", common.DefaultAutoUnsealGracePeriod)
+			common.AutoUnsealGracePeriodSeconds = common.DefaultAutoUnsealGracePeriod
+		}
+	}
+	//	LDAP, policies, secret engines, wait time and retry policy, which are reloaded on change
+	parseReloadableConfig(configMapObject)
+
+	//	Vault scheme, port and TLS settings
+	parseVaultConnectionConfig(configMapObject.Data)
+
+	//	PGP keys of the custodians and the unseal mode
+	parsePGPConfig(configMapObject.Data)
+
+	//	Wrapping of the init keys stored in the secret
+	parseKeyWrappingConfig(configMapObject.Data)
+
+	//	Revocation of the root token after the bootstrap
+	parseInitializerTokenConfig(configMapObject.Data)
 }
 
 // StartRoutine is the chore functionality of the process.
-// i) populates the name of the individual pods and corresponding IPs
-// ii) check for all the available IP addresses for the pods
-// iii) Starts to initialize the vault on a single targeted IP address
-// iv) Unseals the vault on the targeted IP address
-// v) Enables LDAP
-// vi) Configures LDAP
-// vii) Writes the ACL policies
-// viii) Enables the secret engines
-// ix) continues the steps i, ii, iv in a loop to maintain the high-availability when new pods comes
-// or existing pod crashes
+// i) starts the pod informer on the vault pods and rebuilds the tracked pods keyed by their UID
+// ii) Starts to initialize the vault on a single targeted IP address
+// iii) Unseals the vault on the targeted IP address
+// iv) Reconciles the LDAP auth, the ACL policies, their bindings and the secret engines against the config map
+// v) continues the steps i, iii and iv whenever the informer reports a pod change or a resync, to maintain
+// the high-availability when new pods comes or existing pod crashes and to apply the config map edits
 func StartRoutine() {
-	populatePodNameKeysAndIPs()
-	checkIPAvailabilityForAllPods()
-	startInitializingWithIndividualPodIP()
-	checkSealStatus()
-	configureLDAPInPod()
-	writePolicyInPod()
-	enableSecretEngineInPod()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	targets.Start(stopCh)
+	startConfigInformer(stopCh)
+
+	reconcileTrackedPods()
 	for {
-		populatePodNameKeysAndIPs()
-		checkIPAvailabilityForAllPods()
+		err := startInitializingWithIndividualPodIP()
+		if err == nil {
+			break
+		}
+		if !isRetryable(err) {
+			log.Fatalf("Couldn't complete the init process: %v", err)
+		}
+		log.Errorf("Couldn't complete the init process, will be retried on the next pod event: %v", err)
+		waitForPodEvent()
+	}
+	vaultInitialized = true
+	checkSealStatus()
+	if common.UnsealMode == common.UnsealModeManual || isAutoUnsealSeal() {
+		waitForUnsealedPod()
+	}
+	configureVault()
+	reportResourceStatus()
+	for range podEventCh {
+		applyPendingConfig()
+		reconcileTrackedPods()
 		checkSealStatus()
-		time.Sleep(3 * time.Second)
+		configureVault()
+		reportResourceStatus()
 	}
 }
 
-// populatePodNameKeysAndIPs populates the pod names that matches the given label selector
-// and populates the available IP addresses for those corresponding pods
-func populatePodNameKeysAndIPs() {
-	pods, _ := k8s.Clientset.CoreV1().Pods(namespace).List(metaV1.ListOptions{
-		LabelSelector: vaultLabelSelectors,
-		FieldSelector: "status.phase=Running",
-	})
-	for _, pod := range pods.Items {
-		podNameToIPMap[pod.Name] = pod.Status.PodIP
+// configureVault converges the LDAP auth, the policies and the secret engines to the config map; when it
+// fails, false is returned and the configuration is converged again on the next pod event or resync
+func configureVault() bool {
+	changes, err := reconcileVaultConfiguration()
+	if errors.Is(err, errNoAuthToken) {
+		log.Warnf("Skipping the configuration, %v", err)
+		return false
 	}
-	log.Debugf("Populated IP Map %v ", podNameToIPMap)
-}
-
-// checkIPAvailabilityForAllPods will extract the IP Addresses for all the pods that are
-// collected in the populatePodNameKeysAndIPs function and makes sure the IP addresses are
-// available for all; if the pod haven't got the ip assigned yet, it will wait untill all the
-// pod ip are available
-func checkIPAvailabilityForAllPods() {
-	for podName, ip := range podNameToIPMap {
-		if len(ip) == 0 {
-			log.Warnf("No IP address found for %s", podName)
-			populatePodNameKeysAndIPs()
-			break
+	recordReconcileResult(changes, err)
+	if err != nil {
+		if !isRetryable(err) {
+			log.Errorf("error while configuring the vault, fix the config map to converge: %v", err)
+		} else {
+			log.Errorf("error while configuring the vault, will be retried on the next check: %v", err)
 		}
+		return false
 	}
-	log.Debugf("all ips available for identified pods")
+	log.Debug("Vault configuration is converged")
+	return true
 }
 
 // isInitializedOnPodIP will return bool value based on the initialized status on individual pod IP addresses
@@ -161,122 +264,253 @@ func isInitializedOnPodIP(firstPodName, initPodURL string) bool {
 	if err != nil {
 		log.Errorf("error while checking the init status on %s; err: %v", initPodURL, err)
 		return true
-	} else {
-		log.Debugf("Init response from pod %s is %v", firstPodName, string(initStatusResponse))
-		var responseJSON map[string]interface{}
-		json.Unmarshal(initStatusResponse, &responseJSON)
-		if (responseJSON["initialized"]).(bool) {
-			return true
-		} else {
-			return false
-		}
 	}
+	log.Debugf("Init response from pod %s is %v", firstPodName, string(initStatusResponse))
+	var initStatus struct {
+		Initialized bool `json:"initialized"`
+	}
+	if err := parseJSONRespo(initStatusResponse, &initStatus); err != nil {
+		log.Errorf("error while checking the init status on %s; err: %v", initPodURL, err)
+		return true
+	}
+	return initStatus.Initialized
 }
 
 // checkSealStatus will validate the seal status on the individual pods against the pod IPs
 // and unseals them if its sealed. This will unseal all the available pods that are coming up new
 // or coming after a crashed pods and provides the high-availability
 func checkSealStatus() {
-	for podName, podIP := range podNameToIPMap {
-		if isIndividualPodSealed(podName, podIP) {
-			startUnsealingIndividualPod(podName, podIP)
+	for _, podState := range trackedPodList() {
+		sealed := isIndividualPodSealed(podState.Name, podState.IP)
+		if isAutoUnsealSeal() {
+			reportAutoUnsealStatus(recordSealStatus(podState.UID, sealed))
+			continue
 		}
+		if sealed && common.UnsealMode == common.UnsealModeManual {
+			log.Warnf("Vault is sealed on the pod %s, waiting for the unseal shares to be supplied", podState.Name)
+		} else if sealed {
+			if !podOwnsIP(podState) {
+				log.Warnf("pod %s (%s) no longer owns the IP %s, skipping the unseal", podState.Name, podState.UID, podState.IP)
+				continue
+			}
+			if err := startUnsealingIndividualPod(podState.Name, podState.IP); err != nil {
+				log.Errorf("error while unsealing the pod %s, will be retried on the next check: %v", podState.Name, err)
+			}
+			sealed = isIndividualPodSealed(podState.Name, podState.IP)
+		}
+		recordSealStatus(podState.UID, sealed)
 	}
 }
 
-// getFirstResponsivePod will get the first pod in the list of selected vault pods based on the labels
-// provided. This is obtained via HEAD request to the pod ip on default port number 8200. The request is
-// intentionally kept for 1 second wait time. as HEAD request should not take more time than that.
-func getFirstResponsivePod() (firstPodName, firstPodIP string) {
-	log.Info("entering to get the first responsive pod")
+// reportAutoUnsealStatus reports the pods which stay sealed beyond the grace period with an auto-unseal
+// seal, as it means the vault cannot reach its transit or KMS seal
+func reportAutoUnsealStatus(podState common.PodState) {
+	if podState.AutoUnsealFailure {
+		log.Errorf("auto-unseal failure: vault on the pod %s is sealed since %v with the %s seal",
+			podState.Name, podState.SealedSince.Format(time.RFC3339), common.SealType)
+	} else if podState.Sealed {
+		log.Infof("Vault is sealed on the pod %s, waiting for the %s seal to unseal it", podState.Name, common.SealType)
+	}
+}
+
+// waitForUnsealedPod blocks until at least one of the pods is unsealed by the custodians or the auto-unseal, as the
+// configuration cannot be done on a sealed vault. The seal status is re-checked on every pod event
+// and every wait time, as unsealing by hand does not change the pod.
+func waitForUnsealedPod() {
 	for {
-		for podName, podIP := range podNameToIPMap {
-			client := http.Client{Timeout: time.Duration(common.WaitTimeSeconds) * time.Second}
-			res, err := client.Head("http://" + strings.TrimSpace(podIP) + ":8200")
-			if err != nil {
-				log.Errorf("error from getFirstResponsivePod; service running in pod %s still not accepting the connection: %v moving to next pod", podName, err.Error())
-				time.Sleep(1 * time.Second)
-			} else {
-				log.Infof("Service is live with status %v on pod %s", res.Status, podName)
-				firstPodName = podName
-				firstPodIP = podIP
-				break
+		for _, podState := range trackedPodList() {
+			if !podState.Sealed && !podState.LastChecked.IsZero() {
+				log.Infof("Vault is unsealed on the pod %s, proceeding with the configuration", podState.Name)
+				return
 			}
 		}
-		if len(firstPodIP) > 0 && len(firstPodName) > 0 {
-			break
-		} else {
-			continue
+		select {
+		case <-podEventCh:
+		case <-time.After(time.Duration(common.WaitTimeSeconds) * time.Second):
 		}
-		log.Info("no response from any pod, looping again")
+		reconcileTrackedPods()
+		checkSealStatus()
 	}
+}
+
+// waitForPodEvent waits for the next pod event, or for the max backoff when no pod changes
+func waitForPodEvent() {
+	select {
+	case <-podEventCh:
+	case <-time.After(time.Duration(common.RetryMaxBackoffSeconds) * time.Second):
+	}
+	reconcileTrackedPods()
+}
+
+// getFirstResponsivePod will get the first pod in the list of selected vault pods based on the labels
+// provided. This is obtained via HEAD request to the pod ip on the configured scheme and port; when no
+// pod responds, the pods are probed again with the retry policy.
+func getFirstResponsivePod() (firstPodName, firstPodIP string, err error) {
+	log.Info("entering to get the first responsive pod")
+	err = withRetry("probe the vault pods", func(ctx context.Context) error {
+		reconcileTrackedPods()
+		for _, podState := range trackedPodList() {
+			res, err := probePod(podState.IP)
+			if err != nil {
+				log.Errorf("error from getFirstResponsivePod; service running in pod %s still not accepting the connection: %v moving to next pod", podState.Name, err.Error())
+				continue
+			}
+			log.Infof("Service is live with status %v on pod %s", res.Status, podState.Name)
+			firstPodName = podState.Name
+			firstPodIP = podState.IP
+			return nil
+		}
+		return retryableError{fmt.Errorf("no response from any of the vault pods")}
+	})
 	return
 }
 
 // startUnsealingIndividualPod will start the unsealing process
-func startUnsealingIndividualPod(podName, podIP string) {
-	if !parsedKeys.IsEmpty() {
-		unsealIndividualPods(podName, podIP)
-	} else {
-		populateParsedKeys()
-		unsealIndividualPods(podName, podIP)
+func startUnsealingIndividualPod(podName, podIP string) error {
+	if parsedKeys.IsEmpty() {
+		if err := populateParsedKeys(); err != nil {
+			return err
+		}
 	}
+	return unsealIndividualPods(podName, podIP)
 }
 
-// storeInSecret will store the initialized keys
+// storeInSecret will store the initialized keys in the key store, wrapped with the configured key wrapping method.
+// The wrapping method is recorded in the annotations to unwrap them back.
 func storeInSecret(parsedKeys common.VaultInitResp) error {
-	jsonParsedKeys, err := json.Marshal(parsedKeys)
+	keyData, annotations, err := wrapInitKeys(parsedKeys)
 	if err != nil {
 		return err
 	}
-	secretNew := &v1.Secret{
-		ObjectMeta: metaV1.ObjectMeta{
-			Name:   common.VaultKeysSecretName,
-			Labels: map[string]string{"app": "vault", "type": "init-keys"},
-		},
-		StringData: map[string]string{"init-keys": string(jsonParsedKeys)},
-		Type:       v1.SecretTypeOpaque,
-	}
-	_, err = k8s.Clientset.CoreV1().Secrets(namespace).Create(secretNew)
+	return keyStore.Create(common.VaultKeysSecretName, keyData, annotations)
+}
+
+// rewriteInitKeys replaces the stored init keys, once the root token is revoked; the keys are wrapped with
+// the configured method, which is the one recorded in the annotations kept by the write, as populateParsedKeys
+// has read them back only when both are the same
+func rewriteInitKeys(parsedKeys common.VaultInitResp) error {
+	keyData, _, err := wrapInitKeys(parsedKeys)
 	if err != nil {
 		return err
 	}
-	return nil
+	return keyStore.Write(common.VaultKeysSecretName, keyData)
 }
 
-// bindPolicy will bind the given policy to the corresponding user or groups
-func bindPolicy(nouns []string, policyPayload, url string) {
-	for _, indNoun := range nouns {
-		_, err := FireRequest(policyPayload, url+strings.TrimSpace(indNoun), getAuthTokenHeaders(), common.HttpMethodPUT)
+// wrapInitKeys provides the init keys wrapped with the configured key wrapping method, along with the
+// annotations recording the method
+func wrapInitKeys(parsedKeys common.VaultInitResp) (map[string]string, map[string]string, error) {
+	jsonParsedKeys, err := json.Marshal(parsedKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+	storedKeys, annotations, err := wrapStoredValue(jsonParsedKeys, "init keys")
+	if err != nil {
+		return nil, nil, err
+	}
+	return map[string]string{"init-keys": storedKeys}, annotations, nil
+}
+
+// wrapStoredValue provides the value wrapped with the configured key wrapping method, along with the
+// annotations recording the method to unwrap it back
+func wrapStoredValue(value []byte, description string) (string, map[string]string, error) {
+	storedValue := string(value)
+	if keyWrapper.Method() != common.KeyWrappingNone {
+		wrappedValue, err := keyWrapper.Wrap(value)
 		if err != nil {
-			log.Errorf("error while uploading the policy binding: %v to group %s; error: %v", policyPayload, indNoun, err)
+			return "", nil, fmt.Errorf("error while wrapping the %s with %s: %v", description, keyWrapper.Method(), err)
 		}
+		storedValue = base64.StdEncoding.EncodeToString(wrappedValue)
+	}
+	annotations := map[string]string{common.KeyWrappingAnnotation: keyWrapper.Method()}
+	if len(keyWrapper.KeyID()) > 0 {
+		annotations[common.KeyWrappingKeyAnnotation] = keyWrapper.KeyID()
+	}
+	return storedValue, annotations, nil
+}
+
+// unwrapStoredValue provides the stored value unwrapped with the method recorded in the annotations, which
+// has to be the configured one
+func unwrapStoredValue(storedValue string, annotations map[string]string, description string) ([]byte, error) {
+	wrappingMethod := storedWrappingMethod(annotations)
+	if wrappingMethod != keyWrapper.Method() {
+		return nil, fmt.Errorf("%s: wrapped with %s method, but %s method is configured", description, wrappingMethod, keyWrapper.Method())
+	}
+	if wrappingMethod == common.KeyWrappingNone {
+		return []byte(storedValue), nil
+	}
+	wrappedValue, err := base64.StdEncoding.DecodeString(storedValue)
+	if err != nil {
+		return nil, fmt.Errorf("error while decoding the wrapped %s: %v", description, err)
+	}
+	value, err := keyWrapper.Unwrap(wrappedValue)
+	if err != nil {
+		return nil, fmt.Errorf("error while unwrapping the %s with %s: %w", description, wrappingMethod, err)
+	}
+	return value, nil
+}
+
+// storedWrappingMethod provides the key wrapping method recorded in the annotations, none when not recorded
+func storedWrappingMethod(annotations map[string]string) string {
+	if wrappingMethod := annotations[common.KeyWrappingAnnotation]; len(wrappingMethod) > 0 {
+		return wrappingMethod
 	}
+	return common.KeyWrappingNone
 }
 
-// getAuthTokenHeaders provides the auth token
+// getAuthTokenHeaders provides the auth token; the token given in VAULT_TOKEN takes the precedence, then the
+// token of the kubernetes login or the initializer token replacing the root token after the bootstrap, and the
+// root token until then
 func getAuthTokenHeaders() map[string]string {
-	var authTokenHeaders map[string]string
-	if !parsedKeys.IsEmpty() {
-		authTokenHeaders = map[string]string{
-			"X-Vault-Token": parsedKeys.RootToken,
-		}
-	} else {
-		populateParsedKeys()
-		authTokenHeaders = map[string]string{
-			"X-Vault-Token": parsedKeys.RootToken,
+	token, err := authToken()
+	if err != nil {
+		log.Fatalf("couldn't obtain the auth token: %v", err)
+	}
+	return map[string]string{
+		"X-Vault-Token": token,
+	}
+}
+
+// authToken provides the token the vault is configured with, in the order of getAuthTokenHeaders; the root
+// token cannot be used when it is PGP encrypted for a custodian or revoked
+func authToken() (string, error) {
+	if vaultToken, avail := os.LookupEnv(common.VaultTokenEnv); avail && len(vaultToken) > 0 {
+		return vaultToken, nil
+	}
+	if len(loginToken) > 0 && time.Now().Before(loginTokenExpiry) {
+		return loginToken, nil
+	}
+	token, err := loadInitializerToken()
+	if err != nil || len(token) > 0 {
+		return token, err
+	}
+	if parsedKeys.IsEmpty() {
+		if err := populateParsedKeys(); err != nil {
+			return "", err
 		}
 	}
-	return authTokenHeaders
+	if parsedKeys.RootTokenPGPEncrypted {
+		return "", fmt.Errorf("root token is PGP encrypted, provide a token through %s to configure the vault", common.VaultTokenEnv)
+	}
+	if parsedKeys.RootTokenRevoked || len(parsedKeys.RootToken) == 0 {
+		return "", fmt.Errorf("root token is revoked and the initializer can neither log in nor find its token %s, restore it with the generate-root command", common.InitializerTokenSecretName)
+	}
+	return parsedKeys.RootToken, nil
 }
 
-// populateParsedKeys will populate the parsed init-keys again from the secret; as the initializer pod crashes and comes up
-// again this will not be in the session.
-func populateParsedKeys() {
-	keyObjectFromSecret, err := k8s.Clientset.CoreV1().Secrets(namespace).Get(common.VaultKeysSecretName, metaV1.GetOptions{})
+// populateParsedKeys will populate the parsed init-keys again from the key store; as the initializer pod crashes and comes up
+// again this will not be in the session. The keys are unwrapped with the method recorded in the secret annotations,
+// which should match the configured one.
+func populateParsedKeys() error {
+	keyData, keyAnnotations, err := keyStore.Read(common.VaultKeysSecretName)
 	if err != nil {
-		log.Fatalf("couldn't complete the unsealing process, as the secret keys cannot be obtained from k8s; err: %v", err)
-	} else {
-		parseJSONRespo(keyObjectFromSecret.Data["init-keys"], &parsedKeys)
+		return fmt.Errorf("the secret keys cannot be obtained from the key store: %w", err)
 	}
+	storedKeys, err := unwrapStoredValue(keyData["init-keys"], keyAnnotations, "init keys")
+	if err != nil {
+		return err
+	}
+	if err := parseJSONRespo(storedKeys, &parsedKeys); err != nil {
+		return fmt.Errorf("error while parsing the init keys from the secret: %v", err)
+	}
+	return nil
 }
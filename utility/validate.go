@@ -0,0 +1,449 @@
+package utility
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"vault-initializer/common"
+
+	"github.com/hashicorp/hcl"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+var (
+	// knownMountTypes are the secret engine types shipped with vault; the other types are accepted
+	// only along with the plugin_name of a registered plugin
+	knownMountTypes = []string{"ad", "alicloud", "aws", "azure", "consul", "database", "gcp", "gcpkms", "generic",
+		"kmip", "kubernetes", "kv", "kv-v1", "kv-v2", "ldap", "mongodbatlas", "nomad", "openldap", "pki", "rabbitmq", "ssh", "terraform",
+		"totp", "transform", "transit"}
+
+	// positiveIntKeys are the keys expected to hold a positive number
+	positiveIntKeys = []string{"serviceWaitTimeInSeconds", "podResyncPeriodInSeconds", "autoUnsealGracePeriodInSeconds",
+		"retryMaxAttempts", "retryInitialBackoffInMillis", "retryMaxBackoffInSeconds", "requestTimeoutInSeconds"}
+
+	// boolKeys are the keys expected to hold true or false
+	boolKeys = []string{"leaderElectionEnabled", "pruneEnabled", "revokeRootToken"}
+)
+
+// FieldError is the validation failure of a single config key
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) Error() string { return e.Field + ": " + e.Message }
+
+// ValidationErrors are all the validation failures of a config, in the order of the keys
+type ValidationErrors []FieldError
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, 0, len(errs))
+	for _, fieldErr := range errs {
+		messages = append(messages, fieldErr.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// ValidateConfigData validates the config before anything is sent to the vault, all the failures
+// are collected so that a single pass reports every broken key
+func ValidateConfigData(configData map[string]string) error {
+	var errs ValidationErrors
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	_, staticTargets := targets.(*staticTargetProvider)
+	if len(strings.TrimSpace(configData["vaultAddresses"])) > 0 {
+		for _, address := range strings.Split(configData["vaultAddresses"], ",") {
+			parsedURL, err := url.Parse(strings.TrimSpace(address))
+			if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || len(parsedURL.Host) == 0 {
+				fail("vaultAddresses", "%s is not a full address, e.g. https://vault-1:8200", strings.TrimSpace(address))
+			}
+		}
+	} else if len(strings.TrimSpace(configData["vaultLabelSelector"])) == 0 && !staticTargets {
+		fail("vaultLabelSelector", "is required unless the vault addresses are given, e.g. app.kubernetes.io/name=vault,component=server")
+	} else if _, err := labels.Parse(configData["vaultLabelSelector"]); err != nil {
+		fail("vaultLabelSelector", "is not a valid label selector: %v", err)
+	}
+
+	// shares and threshold, as vault would reject them only after the init request
+	shares := validateInt(configData, "secretShares", common.DefaultSecretShares, 1, 255, fail)
+	threshold := validateInt(configData, "secretThreshold", common.DefaultSecretThreshold, 1, 255, fail)
+	validateSharesThreshold("secretShares", "secretThreshold", shares, threshold, fail)
+	recoveryShares := 0
+	if len(configData["recoveryShares"]) > 0 || len(configData["recoveryThreshold"]) > 0 {
+		recoveryShares = validateInt(configData, "recoveryShares", shares, 1, 255, fail)
+		recoveryThreshold := validateInt(configData, "recoveryThreshold", threshold, 1, 255, fail)
+		validateSharesThreshold("recoveryShares", "recoveryThreshold", recoveryShares, recoveryThreshold, fail)
+	}
+
+	for _, key := range positiveIntKeys {
+		validateInt(configData, key, 1, 1, 0, fail)
+	}
+	validateInt(configData, "vaultPort", common.DefaultVaultPort, 1, 65535, fail)
+	for _, key := range boolKeys {
+		if value := strings.TrimSpace(configData[key]); len(value) > 0 {
+			if _, err := strconv.ParseBool(value); err != nil {
+				fail(key, "should be true or false, got %q", value)
+			}
+		}
+	}
+	if value := strings.TrimSpace(configData["initializerTokenPeriod"]); len(value) > 0 {
+		if period, err := time.ParseDuration(value); err != nil || period < time.Hour {
+			fail("initializerTokenPeriod", "should be a duration of at least 1h, e.g. 768h, got %q", value)
+		}
+	}
+	if value := strings.TrimSpace(configData["retryJitter"]); len(value) > 0 {
+		if jitter, err := strconv.ParseFloat(value, 64); err != nil || jitter < 0 || jitter > 1 {
+			fail("retryJitter", "should be a fraction between 0 and 1, got %q", value)
+		}
+	}
+	validateOneOf(configData, "vaultScheme", []string{"http", "https"}, fail)
+	validateOneOf(configData, "unsealMode", []string{common.UnsealModeAuto, common.UnsealModeManual}, fail)
+	certFile, keyFile := strings.TrimSpace(configData["statusTLSCertFile"]), strings.TrimSpace(configData["statusTLSKeyFile"])
+	if (len(certFile) == 0) != (len(keyFile) == 0) {
+		fail("statusTLSCertFile", "should be given along with statusTLSKeyFile")
+	} else if strings.TrimSpace(configData["unsealMode"]) == common.UnsealModeManual && len(certFile) == 0 {
+		fail("statusTLSCertFile", "is required along with statusTLSKeyFile in the %s unseal mode, the shares are only submitted over https", common.UnsealModeManual)
+	}
+	validateOneOf(configData, "keyWrappingMethod", []string{common.KeyWrappingNone, common.KeyWrappingKeyFile,
+		common.KeyWrappingPassphrase, common.KeyWrappingTransit}, fail)
+	switch strings.TrimSpace(configData["keyWrappingMethod"]) {
+	case common.KeyWrappingKeyFile:
+		validateRequired(configData, "keyWrappingKeyFile", "is required for the "+common.KeyWrappingKeyFile+" method", fail)
+	case common.KeyWrappingTransit:
+		validateRequired(configData, "transitAddress", "is required for the "+common.KeyWrappingTransit+" method", fail)
+		validateRequired(configData, "transitKeyName", "is required for the "+common.KeyWrappingTransit+" method", fail)
+	}
+
+	// LDAP auth
+	authErrs := len(errs)
+	if len(strings.TrimSpace(configData["ldapConfig"])) > 0 {
+		var ldapConfig map[string]interface{}
+		if err := json.Unmarshal([]byte(configData["ldapConfig"]), &ldapConfig); err != nil {
+			fail("ldapConfig", "is not a valid JSON object: %v", err)
+		} else if url, _ := ldapConfig["url"].(string); len(url) == 0 {
+			fail("ldapConfig.url", "is required")
+		}
+	} else if len(configData["enableLDAP"]) > 0 || len(configData["ldapPolicyGroupMappings"]) > 0 || len(configData["ldapPolicyBindings"]) > 0 {
+		fail("ldapConfig", "is required along with the other LDAP keys")
+	}
+	if len(configData["enableLDAP"]) > 0 {
+		var enablePayload map[string]interface{}
+		if err := json.Unmarshal([]byte(configData["enableLDAP"]), &enablePayload); err != nil {
+			fail("enableLDAP", "is not a valid JSON object: %v", err)
+		} else if authType, _ := enablePayload["type"].(string); authType != "ldap" {
+			fail("enableLDAP.type", "should be ldap, got %q", authType)
+		}
+	}
+	if len(configData["ldapPolicyGroupMappings"]) > 0 {
+		var policyMappingInterface map[string]map[string][]string
+		if err := json.Unmarshal([]byte(configData["ldapPolicyGroupMappings"]), &policyMappingInterface); err != nil {
+			fail("ldapPolicyGroupMappings", "should be {\"groups\": {\"r_groups\": [...], ...}, \"policies\": {\"r_policy\": [...], ...}}: %v", err)
+		} else {
+			knownKeys := map[string][]string{"groups": {"r_groups", "rw_groups", "r_users", "rw_users"}, "policies": {"r_policy", "rw_policy"}}
+			for _, section := range []string{"groups", "policies"} {
+				keys := knownKeys[section]
+				for _, key := range sortedKeys(policyMappingInterface[section]) {
+					if !containsString(keys, key) {
+						fail("ldapPolicyGroupMappings."+section+"."+key, "is not known, it should be one of %s", strings.Join(keys, ", "))
+					}
+				}
+			}
+		}
+	}
+	if len(configData["ldapPolicyBindings"]) > 0 {
+		var policyBindings map[string]map[string][]string
+		if err := json.Unmarshal([]byte(configData["ldapPolicyBindings"]), &policyBindings); err != nil {
+			fail("ldapPolicyBindings", "should be {\"groups\": {\"<group>\": [\"<policy>\"]}, \"users\": {...}}: %v", err)
+		}
+	}
+
+	// kubernetes auth and the other auth methods
+	if len(configData["kubernetesAuth"]) > 0 {
+		var kubernetesAuth common.KubernetesAuthSpec
+		if err := json.Unmarshal([]byte(configData["kubernetesAuth"]), &kubernetesAuth); err != nil {
+			fail("kubernetesAuth", "should be {\"path\": ..., \"config\": {...}, \"roles\": {\"<role>\": {...}}}: %v", err)
+		}
+		validateKubernetesRoles("kubernetesAuth", kubernetesAuth.Roles, fail)
+	}
+	if len(configData["authMethods"]) > 0 {
+		var authMethods map[string]common.AuthMethodSpec
+		if err := json.Unmarshal([]byte(configData["authMethods"]), &authMethods); err != nil {
+			fail("authMethods", "should be a JSON object of the auth methods keyed by their path: %v", err)
+		}
+		for _, path := range sortedKeys(authMethods) {
+			field := "authMethods." + path
+			if len(strings.Trim(strings.TrimSpace(path), "/")) == 0 {
+				fail(field, "path is empty")
+			}
+			switch authMethods[path].Type {
+			case "":
+				fail(field+".type", "is required")
+			case "token":
+				fail(field+".type", "the token auth method is builtin and cannot be mounted")
+			case "kubernetes":
+				validateKubernetesRoles(field, authMethods[path].Roles, fail)
+			case "jwt", "oidc":
+				validateJWTAuth(field, authMethods[path].Config, authMethods[path].Roles, fail)
+			}
+			validateSecretIDDelivery(field, authMethods[path], fail)
+		}
+	}
+	if len(strings.TrimSpace(configData["breakGlass"])) > 0 {
+		var breakGlass common.BreakGlassSpec
+		if err := json.Unmarshal([]byte(configData["breakGlass"]), &breakGlass); err != nil {
+			fail("breakGlass", "should be {\"users\": <count>, \"policy\": \"<policy>\", \"pgpKeys\": [...]}: %v", err)
+		}
+		if breakGlass.Users < 1 {
+			fail("breakGlass.users", "should be at least 1, got %d", breakGlass.Users)
+		}
+		switch strings.TrimSpace(breakGlass.Policy) {
+		case "":
+			fail("breakGlass.policy", "is required, the admin policy bound to the users")
+		case "root":
+			fail("breakGlass.policy", "the root policy cannot be bound to the users of an auth method")
+		}
+		if len(breakGlass.PGPKeys) > 0 && len(breakGlass.PGPKeys) != breakGlass.Users {
+			fail("breakGlass.pgpKeys", "has %d keys, one per user is needed (%d)", len(breakGlass.PGPKeys), breakGlass.Users)
+		}
+		for i, keyName := range breakGlass.PGPKeys {
+			if strings.HasPrefix(keyName, "keybase:") {
+				fail(fmt.Sprintf("breakGlass.pgpKeys[%d]", i), "keybase references are not supported, give the name of the key in pgpKeysConfigMap or pgpKeysSecret")
+			}
+		}
+		if len(breakGlass.PGPKeys) > 0 && len(configData["pgpKeysConfigMap"]) == 0 && len(configData["pgpKeysSecret"]) == 0 {
+			fail("breakGlass.pgpKeys", "needs the pgpKeysConfigMap or the pgpKeysSecret holding the keys")
+		}
+	}
+	// the conflicting paths, once the auth keys are valid on their own
+	if len(errs) == authErrs {
+		specs, err := authMethodSpecs(configData)
+		if err != nil {
+			fail("authMethods", "%v", err)
+		}
+		if path := strings.Trim(strings.TrimSpace(configData["initializerAuthPath"]), "/"); err == nil && len(path) > 0 {
+			if spec, found := specs[path]; !found {
+				fail("initializerAuthPath", "auth method %s is not declared", path)
+			} else if spec.Type != "kubernetes" {
+				fail("initializerAuthPath", "auth method %s is of type %s, the initializer logs in through a kubernetes auth", path, spec.Type)
+			}
+		}
+	}
+
+	// policies
+	for _, key := range sortedKeys(configData) {
+		if !strings.HasSuffix(key, ".hcl") {
+			continue
+		}
+		if len(strings.TrimSpace(configData[key])) == 0 {
+			fail(key, "policy is empty")
+		} else if _, err := hcl.Parse(configData[key]); err != nil {
+			fail(key, "is not a valid HCL policy: %v", err)
+		}
+	}
+
+	// secret engines
+	if len(configData["secretEngines"]) > 0 {
+		var secretEngineInterface map[string]map[string]interface{}
+		if err := json.Unmarshal([]byte(configData["secretEngines"]), &secretEngineInterface); err != nil {
+			fail("secretEngines", "should be a JSON object of the mount payloads keyed by their path: %v", err)
+		}
+		for _, engineName := range sortedKeys(secretEngineInterface) {
+			mountType, _ := secretEngineInterface[engineName]["type"].(string)
+			_, isPlugin := secretEngineInterface[engineName]["plugin_name"]
+			if len(mountType) == 0 {
+				fail("secretEngines."+engineName+".type", "is required")
+			} else if !isPlugin && !containsString(knownMountTypes, mountType) {
+				fail("secretEngines."+engineName+".type", "%q is not a known secret engine type, give the plugin_name for a custom plugin", mountType)
+			}
+		}
+	}
+
+	// pgp keys and the pruning
+	if len(configData["pgpKeys"]) > 0 {
+		var pgpKeys []string
+		if err := json.Unmarshal([]byte(configData["pgpKeys"]), &pgpKeys); err != nil {
+			fail("pgpKeys", "should be a JSON list of key names: %v", err)
+		} else if recoveryShares > 0 && len(pgpKeys) != shares && len(pgpKeys) != recoveryShares {
+			// the seal type is only known from the vault, the keys are given for the recovery shares with an auto-unseal seal
+			fail("pgpKeys", "has %d keys, one per secret share (%d) or, with an auto-unseal seal, per recovery share (%d) is needed", len(pgpKeys), shares, recoveryShares)
+		} else if recoveryShares == 0 && len(pgpKeys) != shares {
+			fail("pgpKeys", "has %d keys, one per secret share is needed (%d)", len(pgpKeys), shares)
+		}
+	}
+	if len(configData["pruneProtected"]) > 0 {
+		var protected managedObjects
+		if err := json.Unmarshal([]byte(configData["pruneProtected"]), &protected); err != nil {
+			fail("pruneProtected", "should be a JSON object of the name lists: %v", err)
+		}
+		for _, key := range sortedKeys(map[string][]string(protected)) {
+			if !containsString(managedObjectKeyList(), key) {
+				fail("pruneProtected."+key, "is not known, it should be one of %s", strings.Join(managedObjectKeyList(), ", "))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateInt validates the key as a number within the bounds, a max of 0 means unbounded;
+// the parsed value is returned, or the default value when it is not given or invalid
+func validateInt(configData map[string]string, key string, defaultValue, min, max int, fail func(string, string, ...interface{})) int {
+	value := strings.TrimSpace(configData[key])
+	if len(value) == 0 {
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		fail(key, "should be a number, got %q", value)
+		return defaultValue
+	}
+	if parsed < min || (max > 0 && parsed > max) {
+		if max > 0 {
+			fail(key, "should be between %d and %d, got %d", min, max, parsed)
+		} else {
+			fail(key, "should be at least %d, got %d", min, parsed)
+		}
+		return defaultValue
+	}
+	return parsed
+}
+
+// validateSharesThreshold validates the threshold against the shares as vault does on init
+func validateSharesThreshold(sharesKey, thresholdKey string, shares, threshold int, fail func(string, string, ...interface{})) {
+	if threshold > shares {
+		fail(thresholdKey, "%d is greater than %s %d", threshold, sharesKey, shares)
+	} else if shares > 1 && threshold == 1 {
+		fail(thresholdKey, "should be greater than 1 when %s is more than 1", sharesKey)
+	}
+}
+
+// validateOneOf validates the key holds one of the allowed values when it is given
+func validateOneOf(configData map[string]string, key string, allowed []string, fail func(string, string, ...interface{})) {
+	value := strings.TrimSpace(configData[key])
+	if len(value) > 0 && !containsString(allowed, strings.ToLower(value)) {
+		fail(key, "should be one of %s, got %q", strings.Join(allowed, ", "), value)
+	}
+}
+
+// validateRequired validates the key is given
+func validateRequired(configData map[string]string, key, message string, fail func(string, string, ...interface{})) {
+	if len(strings.TrimSpace(configData[key])) == 0 {
+		fail(key, message)
+	}
+}
+
+// containsString returns true when the value is in the list
+func containsString(list []string, value string) bool {
+	for _, listed := range list {
+		if listed == value {
+			return true
+		}
+	}
+	return false
+}
+
+// validateKubernetesRoles validates the roles of a kubernetes auth method bind the service accounts and namespaces
+func validateKubernetesRoles(field string, roles map[string]map[string]interface{}, fail func(string, string, ...interface{})) {
+	for _, roleName := range sortedKeys(roles) {
+		for _, key := range []string{"bound_service_account_names", "bound_service_account_namespaces"} {
+			if _, found := roles[roleName][key]; !found {
+				fail(field+".roles."+roleName+"."+key, "is required")
+			}
+		}
+	}
+}
+
+// validateSecretIDDelivery validates the AppRole secret_ids are delivered for the declared roles of an AppRole
+// auth method, into the distinct secrets, rotated with a valid period
+func validateSecretIDDelivery(field string, spec common.AuthMethodSpec, fail func(string, string, ...interface{})) {
+	secretNames := make(map[string]string)
+	for roleName, delivery := range spec.SecretIDDelivery {
+		deliveryField := field + ".secretIdDelivery." + roleName
+		if spec.Type != "approle" {
+			fail(deliveryField, "is only supported by the approle auth method")
+			continue
+		}
+		if _, found := spec.Roles[roleName]; !found {
+			fail(deliveryField, "role %s is not declared in the roles", roleName)
+		}
+		if len(strings.TrimSpace(delivery.SecretName)) == 0 {
+			fail(deliveryField+".secretName", "is required")
+		} else if other, found := secretNames[delivery.SecretName]; found {
+			fail(deliveryField+".secretName", "%s is used for the role %s as well", delivery.SecretName, other)
+		} else if delivery.SecretName == common.VaultKeysSecretName || delivery.SecretName == common.StateSecretName {
+			fail(deliveryField+".secretName", "%s is used by the initializer itself", delivery.SecretName)
+		}
+		secretNames[delivery.SecretName] = roleName
+		if len(delivery.RotationPeriod) > 0 {
+			if period, err := time.ParseDuration(delivery.RotationPeriod); err != nil || period <= 0 {
+				fail(deliveryField+".rotationPeriod", "should be a positive duration, e.g. 24h, got %q", delivery.RotationPeriod)
+			}
+		}
+	}
+}
+
+// managedObjectKeyList provides the keys of the managed object kinds in sorted order
+func managedObjectKeyList() []string {
+	var keys []string
+	for _, key := range managedObjectKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// LoadConfigFile reads a local YAML or JSON file holding either a ConfigMap manifest, a VaultInitialization
+// manifest or the plain keys of the config map, and provides it in the config map form. The secrets
+// referred to by a VaultInitialization are not resolved, as the file may be read outside of the cluster.
+func LoadConfigFile(path string) (*v1.ConfigMap, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var document map[string]interface{}
+	if err := yaml.NewYAMLOrJSONDecoder(file, 4096).Decode(&document); err != nil {
+		return nil, fmt.Errorf("error while parsing %s: %v", path, err)
+	}
+
+	switch document["kind"] {
+	case common.ResourceKind:
+		return resourceConfigMap(&unstructured.Unstructured{Object: document}, false)
+	case "ConfigMap":
+		var configMap v1.ConfigMap
+		documentJSON, _ := json.Marshal(document)
+		if err := json.Unmarshal(documentJSON, &configMap); err != nil {
+			return nil, fmt.Errorf("error while reading the config map in %s: %v", path, err)
+		}
+		return &configMap, nil
+	}
+	configData := make(map[string]string)
+	for key, value := range document {
+		switch typed := value.(type) {
+		case string:
+			configData[key] = typed
+		case map[string]interface{}, []interface{}:
+			// the JSON valued keys may be given as YAML objects in the file
+			valueJSON, _ := json.Marshal(typed)
+			configData[key] = string(valueJSON)
+		default:
+			configData[key] = fmt.Sprint(typed)
+		}
+	}
+	configMap := &v1.ConfigMap{Data: configData}
+	configMap.Name = path
+	return configMap, nil
+}
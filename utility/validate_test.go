@@ -0,0 +1,160 @@
+package utility
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"vault-initializer/common"
+)
+
+func TestValidateConfigData(t *testing.T) {
+	config := func(fields map[string]string) map[string]string {
+		configData := map[string]string{"vaultLabelSelector": "app.kubernetes.io/name=vault,component=server"}
+		for key, value := range fields {
+			if len(value) == 0 {
+				delete(configData, key)
+			} else {
+				configData[key] = value
+			}
+		}
+		return configData
+	}
+	const kubernetesRole = `{"bound_service_account_names": ["vault-initializer"], "bound_service_account_namespaces": ["vault"]}`
+
+	tests := []struct {
+		name       string
+		configData map[string]string
+		fields     []string
+	}{
+		{name: "label selector alone", configData: config(nil)},
+		{name: "vault addresses instead of the label selector", configData: config(map[string]string{"vaultLabelSelector": "", "vaultAddresses": "https://vault-1:8200, https://vault-2:8200"})},
+		{name: "neither addresses nor label selector", configData: config(map[string]string{"vaultLabelSelector": ""}), fields: []string{"vaultLabelSelector"}},
+		{name: "invalid label selector", configData: config(map[string]string{"vaultLabelSelector": "app in (vault"}), fields: []string{"vaultLabelSelector"}},
+		{name: "address without scheme", configData: config(map[string]string{"vaultAddresses": "vault-1:8200"}), fields: []string{"vaultAddresses"}},
+		{
+			name:       "shares and threshold",
+			configData: config(map[string]string{"secretShares": "5", "secretThreshold": "3", "recoveryShares": "3", "recoveryThreshold": "2"}),
+		},
+		{name: "threshold above the shares", configData: config(map[string]string{"secretShares": "3", "secretThreshold": "4"}), fields: []string{"secretThreshold"}},
+		{name: "threshold of 1 with more shares", configData: config(map[string]string{"secretShares": "3", "secretThreshold": "1"}), fields: []string{"secretThreshold"}},
+		{name: "shares which are not a number", configData: config(map[string]string{"secretShares": "five"}), fields: []string{"secretShares"}},
+		{name: "too many shares", configData: config(map[string]string{"secretShares": "256"}), fields: []string{"secretShares"}},
+		{name: "recovery threshold above the shares", configData: config(map[string]string{"recoveryShares": "2", "recoveryThreshold": "3"}), fields: []string{"recoveryThreshold"}},
+		{
+			name:       "numbers, flags and durations",
+			configData: config(map[string]string{"podResyncPeriodInSeconds": "0", "vaultPort": "70000", "revokeRootToken": "yes", "initializerTokenPeriod": "30m", "retryJitter": "1.5"}),
+			fields:     []string{"initializerTokenPeriod", "podResyncPeriodInSeconds", "retryJitter", "revokeRootToken", "vaultPort"},
+		},
+		{name: "unknown scheme and unseal mode", configData: config(map[string]string{"vaultScheme": "ftp", "unsealMode": "sometimes"}), fields: []string{"unsealMode", "vaultScheme"}},
+		{name: "status certificate without its key", configData: config(map[string]string{"statusTLSCertFile": "/tls/tls.crt"}), fields: []string{"statusTLSCertFile"}},
+		{name: "manual unseal without TLS", configData: config(map[string]string{"unsealMode": common.UnsealModeManual}), fields: []string{"statusTLSCertFile"}},
+		{
+			name:       "manual unseal with TLS",
+			configData: config(map[string]string{"unsealMode": common.UnsealModeManual, "statusTLSCertFile": "/tls/tls.crt", "statusTLSKeyFile": "/tls/tls.key"}),
+		},
+		{name: "key file method without the key file", configData: config(map[string]string{"keyWrappingMethod": common.KeyWrappingKeyFile}), fields: []string{"keyWrappingKeyFile"}},
+		{name: "transit method without the transit", configData: config(map[string]string{"keyWrappingMethod": common.KeyWrappingTransit}), fields: []string{"transitAddress", "transitKeyName"}},
+		{name: "unknown wrapping method", configData: config(map[string]string{"keyWrappingMethod": "rot13"}), fields: []string{"keyWrappingMethod"}},
+		{
+			name:       "LDAP auth",
+			configData: config(map[string]string{"ldapConfig": `{"url": "ldaps://ldap.example.com"}`, "enableLDAP": `{"type": "ldap"}`, "ldapPolicyBindings": `{"groups": {"admins": ["admin"]}}`}),
+		},
+		{name: "LDAP config without the URL", configData: config(map[string]string{"ldapConfig": `{"binddn": "cn=vault"}`}), fields: []string{"ldapConfig.url"}},
+		{name: "LDAP keys without the LDAP config", configData: config(map[string]string{"enableLDAP": `{"type": "ldap"}`}), fields: []string{"ldapConfig"}},
+		{
+			name:       "LDAP mount of another type",
+			configData: config(map[string]string{"ldapConfig": `{"url": "ldaps://ldap.example.com"}`, "enableLDAP": `{"type": "userpass"}`}),
+			fields:     []string{"enableLDAP.type"},
+		},
+		{
+			name:       "unknown LDAP mapping key",
+			configData: config(map[string]string{"ldapConfig": `{"url": "ldaps://ldap.example.com"}`, "ldapPolicyGroupMappings": `{"groups": {"admins": ["vault-admins"]}}`}),
+			fields:     []string{"ldapPolicyGroupMappings.groups.admins"},
+		},
+		{
+			name:       "kubernetes auth for the initializer",
+			configData: config(map[string]string{"kubernetesAuth": `{"roles": {"initializer": ` + kubernetesRole + `}}`, "initializerAuthPath": "kubernetes"}),
+		},
+		{
+			name:       "kubernetes role without the bound service accounts",
+			configData: config(map[string]string{"kubernetesAuth": `{"roles": {"app": {"policies": ["app"]}}}`}),
+			fields:     []string{"kubernetesAuth.roles.app.bound_service_account_names", "kubernetesAuth.roles.app.bound_service_account_namespaces"},
+		},
+		{
+			name:       "builtin and untyped auth methods",
+			configData: config(map[string]string{"authMethods": `{"token": {"type": "token"}, "github": {}}`}),
+			fields:     []string{"authMethods.github.type", "authMethods.token.type"},
+		},
+		{
+			name:       "auth method declared twice",
+			configData: config(map[string]string{"authMethods": `{"kubernetes": {"type": "kubernetes"}}`, "kubernetesAuth": `{"roles": {}}`}),
+			fields:     []string{"authMethods"},
+		},
+		{name: "undeclared initializer auth path", configData: config(map[string]string{"initializerAuthPath": "kubernetes"}), fields: []string{"initializerAuthPath"}},
+		{
+			name:       "initializer auth path of another type",
+			configData: config(map[string]string{"authMethods": `{"userpass": {"type": "userpass"}}`, "initializerAuthPath": "userpass/"}),
+			fields:     []string{"initializerAuthPath"},
+		},
+		{name: "break-glass admins", configData: config(map[string]string{"breakGlass": `{"users": 2, "policy": "admin"}`})},
+		{
+			name:       "break-glass admins with the root policy and no user",
+			configData: config(map[string]string{"breakGlass": `{"users": 0, "policy": "root"}`}),
+			fields:     []string{"breakGlass.policy", "breakGlass.users"},
+		},
+		{
+			name:       "break-glass PGP keys without their source",
+			configData: config(map[string]string{"breakGlass": `{"users": 2, "policy": "admin", "pgpKeys": ["alice", "keybase:bob"]}`}),
+			fields:     []string{"breakGlass.pgpKeys", "breakGlass.pgpKeys[1]"},
+		},
+		{name: "policy", configData: config(map[string]string{"admin.hcl": `path "sys/*" { capabilities = ["read"] }`})},
+		{
+			name:       "empty and invalid policies",
+			configData: config(map[string]string{"empty.hcl": " ", "broken.hcl": `path "sys/*" { capabilities = `}),
+			fields:     []string{"broken.hcl", "empty.hcl"},
+		},
+		{
+			name:       "secret engines",
+			configData: config(map[string]string{"secretEngines": `{"secret": {"type": "kv-v2"}, "legacy": {"type": "kv-v1"}, "custom": {"type": "acme-secrets", "plugin_name": "acme-secrets"}}`}),
+		},
+		{
+			name:       "unknown and untyped secret engines",
+			configData: config(map[string]string{"secretEngines": `{"secret": {"type": "kv3"}, "pki": {"description": "certificates"}}`}),
+			fields:     []string{"secretEngines.pki.type", "secretEngines.secret.type"},
+		},
+		{name: "PGP key per share", configData: config(map[string]string{"secretShares": "3", "secretThreshold": "2", "pgpKeys": `["alice", "bob", "carol"]`})},
+		{
+			name:       "PGP key per recovery share",
+			configData: config(map[string]string{"secretShares": "5", "secretThreshold": "3", "recoveryShares": "2", "recoveryThreshold": "2", "pgpKeys": `["alice", "bob"]`}),
+		},
+		{name: "PGP keys short of the shares", configData: config(map[string]string{"secretShares": "3", "secretThreshold": "2", "pgpKeys": `["alice"]`}), fields: []string{"pgpKeys"}},
+		{name: "protected objects", configData: config(map[string]string{"pruneProtected": `{"policies": ["admin"], "authObjects": ["kubernetes/role/app"]}`})},
+		{name: "unknown protected kind", configData: config(map[string]string{"pruneProtected": `{"ldapGroups": ["admins"]}`}), fields: []string{"pruneProtected.ldapGroups"}},
+		{
+			name:       "every failure is collected",
+			configData: config(map[string]string{"vaultLabelSelector": "", "secretShares": "five", "vaultScheme": "ftp", "secretEngines": `{"secret": {}}`}),
+			fields:     []string{"secretEngines.secret.type", "secretShares", "vaultLabelSelector", "vaultScheme"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateConfigData(test.configData)
+			var fields []string
+			if err != nil {
+				var validationErrs ValidationErrors
+				if !errors.As(err, &validationErrs) {
+					t.Fatalf("expected the validation errors, got %T: %v", err, err)
+				}
+				for _, fieldErr := range validationErrs {
+					fields = append(fields, fieldErr.Field)
+					t.Logf("%v", fieldErr)
+				}
+			}
+			sort.Strings(fields)
+			if !reflect.DeepEqual(fields, test.fields) {
+				t.Fatalf("expected the failed fields %v, got %v", test.fields, fields)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package utility
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// VaultAPIError is returned by FireRequest when vault responds with a non successful status code,
+// carrying the errors array decoded from the vault error body
+type VaultAPIError struct {
+	StatusCode int
+	Method     string
+	Path       string
+	Errors     []string
+}
+
+func (e *VaultAPIError) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("vault responded %d to %s %s", e.StatusCode, e.Method, e.Path)
+	}
+	return fmt.Sprintf("vault responded %d to %s %s: %s", e.StatusCode, e.Method, e.Path, strings.Join(e.Errors, "; "))
+}
+
+// newVaultAPIError decodes the vault error body {"errors": [...]} of the failed request
+func newVaultAPIError(statusCode int, method, requestURL string, body []byte) *VaultAPIError {
+	apiError := &VaultAPIError{
+		StatusCode: statusCode,
+		Method:     method,
+		Path:       requestURL,
+	}
+	if parsedURL, err := url.Parse(requestURL); err == nil {
+		apiError.Path = parsedURL.Path
+	}
+	var errorBody struct {
+		Errors []string `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &errorBody); err == nil {
+		apiError.Errors = errorBody.Errors
+	} else if len(strings.TrimSpace(string(body))) > 0 {
+		apiError.Errors = []string{strings.TrimSpace(string(body))}
+	}
+	return apiError
+}
@@ -1,183 +1,184 @@
 package utility
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	log "github.com/sirupsen/logrus"
-	"net/http"
-	"strings"
 	"time"
 	"vault-initializer/common"
 )
 
-// startInitializingWithIndividualPodIP starts the pod initializing on a targeted IP address
-func startInitializingWithIndividualPodIP() {
-	firstPodName, firstPodIP := getFirstResponsivePod()
+// startInitializingWithIndividualPodIP starts the pod initializing on a targeted IP address.
+// The seal type is detected first; with an auto-unseal seal (transit, KMS...) the vault is initialized
+// with the recovery shares and the recovery keys are stored instead of the unseal keys.
+func startInitializingWithIndividualPodIP() error {
+	firstPodName, firstPodIP, err := getFirstResponsivePod()
+	if err != nil {
+		return err
+	}
 	log.Infof("entering the initialization mode against pod name %s with podIP %s", firstPodName, firstPodIP)
+	if err := detectSealType(firstPodName, firstPodIP); err != nil {
+		return err
+	}
 
-	initPodURL := "http://" + strings.TrimSpace(firstPodIP) + ":8200/v1/sys/init"
-	if !isInitializedOnPodIP(firstPodName, initPodURL) {
-		initJSONString := fmt.Sprintf("{ \"secret_shares\": %d, \"secret_threshold\": %d }", common.SecShares, common.SecThreshold)
-		initResponse, err := FireRequest(initJSONString, initPodURL, nil, common.HttpMethodPUT)
-		if err != nil {
-			log.Fatalf("Couldn't complete the init process, following error occurred: %v", err)
-		}
-		parseJSONRespo(initResponse, &parsedKeys)
-		log.Debugf("The parsed Keys are %s ", parsedKeys)
-		err = storeInSecret(parsedKeys)
-		if err != nil {
-			log.Fatalf("error while storing the init keys into k8s secrets: %v", err)
-		}
-	} else {
+	initPodURL := podBaseURL(firstPodIP) + "/v1/sys/init"
+	if isInitializedOnPodIP(firstPodName, initPodURL) {
 		log.Infof("Vault running on %s pod is already initialized", firstPodName)
+		return nil
 	}
-}
-
-// configureLDAPInPod will start enabling the LDAP auth method and
-// configures to the given LDAP servers
-func configureLDAPInPod() {
-	firstPodName, firstPodIP := getFirstResponsivePod()
-	ldapEnablePodURL := "http://" + strings.TrimSpace(firstPodIP) + ":8200/v1/sys/auth/ldap"
-	ldapConfigPodURL := "http://" + strings.TrimSpace(firstPodIP) + ":8200/v1/auth/ldap/config"
-	_, err := FireRequest(enableLDAPJsonStr, ldapEnablePodURL, getAuthTokenHeaders(), common.HttpMethodPOST)
-	if err != nil {
-		log.Fatalf("Couldn't complete the ldap configuration process, following error occurred on %s pod: %v", firstPodName, err)
+	initRequest := common.VaultInitReq{}
+	shares := common.SecShares
+	if isAutoUnsealSeal() {
+		shares = common.RecoveryShares
+		initRequest.RecoveryShares = common.RecoveryShares
+		initRequest.RecoveryThreshold = common.RecoveryThreshold
 	} else {
-		_, err := FireRequest(ldapConfigString, ldapConfigPodURL, getAuthTokenHeaders(), common.HttpMethodPUT)
+		initRequest.SecretShares = common.SecShares
+		initRequest.SecretThreshold = common.SecThreshold
+	}
+	if len(pgpKeyNames) > 0 || len(rootTokenPGPKeyName) > 0 {
+		if len(pgpKeyNames) > 0 && len(pgpKeyNames) != shares {
+			return fmt.Errorf("%d pgp keys are given, but the shares is %d; one key is needed per share", len(pgpKeyNames), shares)
+		}
+		pgpKeys, rootTokenPGPKey, err := loadPGPKeys()
 		if err != nil {
-			log.Fatalf("Couldn't complete the configuration of LDAP auth on %s pod, following error occurred: %v", firstPodName, err)
+			return fmt.Errorf("error while loading the pgp keys: %w", err)
 		}
+		if isAutoUnsealSeal() {
+			initRequest.RecoveryPGPKeys = pgpKeys
+		} else {
+			initRequest.PGPKeys = pgpKeys
+		}
+		initRequest.RootTokenPGPKey = rootTokenPGPKey
+	}
+	initJSONBytes, err := json.Marshal(initRequest)
+	if err != nil {
+		return fmt.Errorf("error while marshalling the init payload: %v", err)
+	}
+	initResponse, err := fireInitRequest(string(initJSONBytes), firstPodIP, initPodURL)
+	if err != nil {
+		return err
 	}
+	if err := parseJSONRespo(initResponse, &parsedKeys); err != nil {
+		return fmt.Errorf("the init response cannot be parsed: %v", err)
+	}
+	// the shares are kept in the order of the pgp keys, so each custodian can pick their own share
+	parsedKeys.Custodians = pgpKeyNames
+	parsedKeys.RootTokenPGPEncrypted = len(rootTokenPGPKeyName) > 0
+	log.Debugf("Vault is initialized with %d key shares", len(parsedKeys.Keys))
+	if err := storeInSecret(parsedKeys); err != nil {
+		// the vault is initialized already, the keys would be lost when retried
+		log.Fatalf("error while storing the init keys into k8s secrets: %v", err)
+	}
+	return nil
 }
 
-// enableSecretEngineInPod will enables the given secret engine in the configmap
-func enableSecretEngineInPod() {
-	firstPodName, firstPodIP := getFirstResponsivePod()
-	secretEnginesPodURL := "http://" + strings.TrimSpace(firstPodIP) + ":8200/v1/sys/mounts/"
-	if len(configMapObject.Data["secretEngines"]) > 0 {
-		var secretEngineInterface map[string]map[string]interface{}
-		json.Unmarshal([]byte(configMapObject.Data["secretEngines"]), &secretEngineInterface)
-		for engineName, payloadJsonStr := range secretEngineInterface {
-			byteArr, err := json.Marshal(payloadJsonStr)
-			if err != nil {
-				log.Fatalf("error while marshalling the payload for %s engine", engineName)
-			} else {
-				log.Debugf("proceeding to enable the engine path %s with the payload %s on the pod %s", engineName, string(byteArr), firstPodName)
-				_, err := FireRequest(string(byteArr), secretEnginesPodURL+strings.TrimSpace(engineName), getAuthTokenHeaders(), common.HttpMethodPUT)
-				if err != nil {
-					log.Fatalf("error while enabling the secret engine to pod %s as %s", firstPodName, engineName)
-				}
-			}
-		}
+// fireInitRequest sends the init request once, never retried, with a timeout long enough for the slow seals;
+// the keys are only in the response, a retry of an init completed meanwhile gets them lost. When the request
+// fails, the init status is read again so a lost response is reported as such instead of being retried.
+func fireInitRequest(payload, podIP, initPodURL string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), common.InitRequestTimeout*time.Second)
+	defer cancel()
+	initResponse, err := fireRequestWithClient(ctx, vaultHTTPClient, payload, initPodURL, nil, common.HttpMethodPUT)
+	if err == nil {
+		return initResponse, nil
 	}
+	sealStatus, statusErr := getSealStatus(podIP)
+	if statusErr != nil {
+		return nil, fmt.Errorf("init request failed and the init status cannot be read, the vault may be initialized with its unseal keys and root token lost; check it before a new init: %v (status: %v)", err, statusErr)
+	}
+	if sealStatus.Initialized {
+		return nil, fmt.Errorf("init request failed, but the vault is initialized; the unseal keys and the root token in the lost response are gone, the vault has to be re-created: %v", err)
+	}
+	// the vault is not initialized, the init is safely retried
+	return nil, err
 }
 
-// writePolicyInPod will extract the mapping for the policy to the user and/or group and binds it accordingly
-func writePolicyInPod() {
-
-	firstPodName, firstPodIP := getFirstResponsivePod()
-	policyWritePodURL := "http://" + strings.TrimSpace(firstPodIP) + ":8200/v1/sys/policy/"
-	ldapConfigGroupPolicyPodURL := "http://" + strings.TrimSpace(firstPodIP) + ":8200/v1/auth/ldap/groups/"
-	ldapConfigUserPolicyPodURL := "http://" + strings.TrimSpace(firstPodIP) + ":8200/v1/auth/ldap/users/"
-
-	for key, val := range configMapObject.Data {
-		if strings.HasSuffix(key, ".hcl") {
-			log.Infof("Proceeding to write the policy %s with the value: %v", key, val)
-			byteDataArray, err := json.Marshal(val)
-			jsonPayload := `{ "policy":` + string(byteDataArray) + `}`
-			if err != nil {
-				log.Errorf("error in marshalling the %s file for passing as payload", err)
-			} else {
-				response, err := FireRequest(jsonPayload, policyWritePodURL+strings.TrimSuffix(key, ".hcl"), getAuthTokenHeaders(), common.HttpMethodPUT)
-				if err != nil {
-					log.Errorf("error while creating %s policy on %s pod: %v ", key, firstPodName, err)
-				}
-				log.Debugf("response from write policy on the pod %s is: %v", firstPodName, response)
-			}
-		}
+// detectSealType detects the seal type from the seal status of the given pod. The shamir seal
+// needs the unseal keys, any other seal unseals itself and uses the recovery keys.
+func detectSealType(podName, podIP string) error {
+	sealStatus, err := getSealStatus(podIP)
+	if err != nil {
+		return fmt.Errorf("error while detecting the seal type on the pod %s: %w", podName, err)
 	}
-
-	log.Infof("Policy upload done, proceeding to bind the policies.")
-	if len(configMapObject.Data["ldapPolicyGroupMappings"]) > 0 {
-		var policyMappingInterface map[string]map[string][]string
-		err := json.Unmarshal([]byte(configMapObject.Data["ldapPolicyGroupMappings"]), &policyMappingInterface)
-		if err != nil {
-			log.Errorf("error while un-marshalling the policy mappings, err: %v", err)
-		} else {
-			readGroups := policyMappingInterface["groups"]["r_groups"]
-			readWriteGroups := policyMappingInterface["groups"]["rw_groups"]
-			readUsers := policyMappingInterface["groups"]["r_users"]
-			readWriteUsers := policyMappingInterface["groups"]["rw_users"]
-
-			readPolicies := policyMappingInterface["policies"]["r_policy"]
-			readPolicyPayload := `{"policies":"` + strings.Join(readPolicies, ",") + `"}`
-			readWritePolicies := policyMappingInterface["policies"]["rw_policy"]
-			readWritePolicyPayload := `{"policies":"` + strings.Join(readWritePolicies, ",") + `"}`
-
-			bindPolicy(readGroups, readPolicyPayload, ldapConfigGroupPolicyPodURL)
-			bindPolicy(readWriteGroups, readWritePolicyPayload, ldapConfigGroupPolicyPodURL)
-			bindPolicy(readUsers, readPolicyPayload, ldapConfigUserPolicyPodURL)
-			bindPolicy(readWriteUsers, readWritePolicyPayload, ldapConfigUserPolicyPodURL)
-		}
-	} else {
-		log.Info("No policy mappings found for the groups")
+	common.SealType = sealStatus.Type
+	if len(common.SealType) == 0 {
+		common.SealType = common.SealTypeShamir
 	}
+	if sealStatus.RecoverySeal && common.SealType == common.SealTypeShamir {
+		common.SealType = common.SealTypeRecovery
+	}
+	log.Infof("Vault is using the %s seal, auto-unseal: %v", common.SealType, isAutoUnsealSeal())
+	return nil
+}
+
+// isAutoUnsealSeal returns true when the vault unseals itself through transit, KMS or HSM seal,
+// in which case the pods are only monitored and never unsealed by the initializer
+func isAutoUnsealSeal() bool {
+	return len(common.SealType) > 0 && common.SealType != common.SealTypeShamir
 }
 
 // unsealIndividualPods starts unsealing the individual pods given their IP using the init keys
 // if the error is "no host available", it means the pod is terminated. the control will go to re-populate the
 // pod names and IP addresses for the same
-func unsealIndividualPods(podName, podIP string) {
-	podURL := "http://" + strings.TrimSpace(podIP) + ":8200"
-	podUnsealURL := "http://" + strings.TrimSpace(podIP) + ":8200/v1/sys/unseal"
+func unsealIndividualPods(podName, podIP string) error {
+	podUnsealURL := podBaseURL(podIP) + "/v1/sys/unseal"
 
-	for {
-		res, err := http.Head(podURL)
+	err := withRetry("probe the pod "+podName, func(ctx context.Context) error {
+		res, err := probePod(podIP)
 		if err != nil {
-			log.Errorf("error from unsealIndividualPods; service running in pod %s is not accepting the connection: %v waiting for %d seconds...", podName, err.Error(), common.WaitTime)
-			// If the pod gets deleted and a new pod comes up, the loop should break and re-populate the IPs
-			if strings.Contains(err.Error(), "connect: no route to host") {
-				time.Sleep(5 * time.Second)
-				populatePodNameKeysAndIPs()
-				return
-			}
-			time.Sleep(time.Duration(common.WaitTimeSeconds) * time.Second)
-		} else {
-			log.Infof("Service is live with status %v", res.Status)
-			break
+			log.Errorf("error from unsealIndividualPods; service running in pod %s is not accepting the connection: %v", podName, err.Error())
+			return err
 		}
+		log.Infof("Service is live with status %v", res.Status)
+		return nil
+	})
+	if err != nil {
+		// If the pod gets deleted and a new pod comes up, the tracked pods are re-populated
+		reconcileTrackedPods()
+		return err
 	}
 
-	for sharesCount := 0; sharesCount < common.SecThreshold; sharesCount++ {
+	// the threshold is the one the vault was initialized with, the configured one may have changed since
+	sealStatus, err := getSealStatus(podIP)
+	if err != nil {
+		return fmt.Errorf("couldn't read the seal status of the pod %s: %w", podName, err)
+	}
+	if sealStatus.T <= 0 {
+		return fmt.Errorf("seal status of the pod %s has no unseal threshold", podName)
+	}
+	if sealStatus.T > len(parsedKeys.Keys) {
+		return fmt.Errorf("pod %s needs %d unseal keys, only %d are stored", podName, sealStatus.T, len(parsedKeys.Keys))
+	}
+	for sharesCount := 0; sharesCount < sealStatus.T; sharesCount++ {
 		jsonUnsealString := fmt.Sprintf("{\"key\": \"%s\"}", parsedKeys.Keys[sharesCount])
 		responseBody, err := FireRequest(jsonUnsealString, podUnsealURL, nil, common.HttpMethodPUT)
 		if err != nil {
-			log.Fatalf("Couldn't complete the unseal process for the pod %s, following error occurred: %v", podName, err)
+			return fmt.Errorf("couldn't complete the unseal process for the pod %s: %w", podName, err)
+		}
+		if err := parseJSONRespo(responseBody, &unsealResponse); err != nil {
+			return fmt.Errorf("couldn't complete the unseal process for the pod %s: %w", podName, err)
 		}
-		parseJSONRespo(responseBody, &unsealResponse)
 	}
 	if unsealResponse.Progress == 0 {
-		log.Info("Unsealing for the pod %s is done.", podName)
+		log.Infof("Unsealing for the pod %s is done.", podName)
 	}
+	return nil
 }
 
 // isIndividualPodSealed returns a bool value for seal status on an individual pod given the IP address
 func isIndividualPodSealed(podName, podIP string) bool {
-	podURL := "http://" + strings.TrimSpace(podIP) + ":8200/v1/sys/seal-status"
-	sealStatusResponse, err := FireRequest("", podURL, nil, common.HttpMethodGET)
+	sealStatus, err := getSealStatus(podIP)
 	if err != nil {
-		log.Errorf("error while checking the seal status on %s; err: %v", podURL, err)
+		log.Errorf("error while checking the seal status on %s; err: %v", podName, err)
+		return true
+	}
+	log.Debugf("Seal response %+v", sealStatus)
+	if sealStatus.Sealed {
+		log.Infof("Vault is sealed on the pod %s", podName)
 		return true
-	} else {
-		log.Debugf("Seal response %v", string(sealStatusResponse))
-		var responseJSON map[string]interface{}
-		json.Unmarshal(sealStatusResponse, &responseJSON)
-		if (responseJSON["sealed"]).(bool) {
-			log.Infof("Vault is sealed on the pod %s", podName)
-			return true
-		} else {
-			log.Infof("Vault is un-sealed on the pod %s", podName)
-			return false
-		}
 	}
+	log.Infof("Vault is un-sealed on the pod %s", podName)
+	return false
 }